@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/distribution/distribution/v3/registry/auth/token"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ACLFile = flag.String("acl", "", "Path to a yaml file of access control rules for authenticated users")
+)
+
+// ACL is a list of rules limiting what authenticated users can do, a nil ACL allows authenticated users everything
+type ACL []*ACLEntry
+
+// ACLEntry grants the listed users, and members of the listed groups, the listed actions on any resource matching
+// one of the repository patterns
+type ACLEntry struct {
+	Users        []string `yaml:"users"`
+	Groups       []string `yaml:"groups"`
+	Type         string   `yaml:"type"`
+	Repositories []string `yaml:"repositories"`
+	Actions      []string `yaml:"actions"`
+	patterns     []*regexp.Regexp
+}
+
+func LoadACL(path string) (ACL, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseACL(data)
+}
+
+func ParseACL(input []byte) (ACL, error) {
+	acl := ACL{}
+	err := yaml.UnmarshalStrict(input, &acl)
+	if err != nil {
+		return nil, err
+	}
+	for index, entry := range acl {
+		if entry.Type == "" {
+			entry.Type = "repository"
+		}
+		if len(entry.Actions) == 0 {
+			return nil, fmt.Errorf("acl entry %d has no actions", index+1)
+		}
+		for _, repository := range entry.Repositories {
+			pattern, err := compilePattern(repository)
+			if err != nil {
+				return nil, fmt.Errorf("acl entry %d: %w", index+1, err)
+			}
+			entry.patterns = append(entry.patterns, pattern)
+		}
+	}
+	return acl, nil
+}
+
+func (a ACL) allowedActions(user string, groups []string, scope *token.ResourceActions) []string {
+	var allowed []string
+	for _, entry := range a {
+		if entry.matches(user, groups, scope) {
+			allowed = append(allowed, entry.Actions...)
+		}
+	}
+	return allowed
+}
+
+func (a ACL) restrict(user string, groups []string, scope *token.ResourceActions, isPublic bool) *token.ResourceActions {
+	allowed := a.allowedActions(user, groups, scope)
+	if isPublic {
+		allowed = append(allowed, "pull")
+	}
+	actions := intersectActions(scope.Actions, allowed)
+	if len(actions) == 0 {
+		log.Debugf("Scope rejected (acl) - User: %s, Type: %s, Name: %s", user, scope.Type, scope.Name)
+		return nil
+	}
+	log.Debugf("Scope restricted (acl) - User: %s, Type: %s, Name: %s, Actions: %v", user, scope.Type, scope.Name, actions)
+	return &token.ResourceActions{
+		Type:    scope.Type,
+		Class:   scope.Class,
+		Name:    scope.Name,
+		Actions: actions,
+	}
+}
+
+func (e *ACLEntry) matches(user string, groups []string, scope *token.ResourceActions) bool {
+	if e.Type != scope.Type {
+		return false
+	}
+	if !containsOrWildcard(e.Users, user) && !matchesAnyGroup(e.Groups, groups) {
+		return false
+	}
+	return matchesAnyPattern(e.patterns, scope.Name)
+}
+
+func containsOrWildcard(list []string, value string) bool {
+	for _, item := range list {
+		if item == "*" || item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// intersectActions returns the requested actions that are allowed, an allowed "*" permits any requested action
+func intersectActions(requested []string, allowed []string) []string {
+	actions := make([]string, 0)
+	for _, action := range requested {
+		if containsOrWildcard(allowed, action) {
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
+
+// compilePattern converts a repository glob into a regexp, "*" and "?" match within a single path segment and
+// "**" matches across segments
+func compilePattern(glob string) (*regexp.Regexp, error) {
+	return regexp.Compile("^" + globToRegexp(glob) + "$")
+}
+
+func globToRegexp(glob string) string {
+	var builder strings.Builder
+	for index := 0; index < len(glob); index++ {
+		switch {
+		case strings.HasPrefix(glob[index:], "**"):
+			builder.WriteString(".*")
+			index++
+		case glob[index] == '*':
+			builder.WriteString("[^/]*")
+		case glob[index] == '?':
+			builder.WriteString("[^/]")
+		default:
+			builder.WriteString(regexp.QuoteMeta(glob[index : index+1]))
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/auth/token"
+)
+
+const testACL = `
+- users: [ci]
+  repositories: ["ci/*"]
+  actions: [pull, push]
+- users: [greboid]
+  repositories: ["**"]
+  actions: ["*"]
+- users: ["*"]
+  repositories: ["shared/**"]
+  actions: [pull]
+- groups: [release]
+  repositories: ["prod/**"]
+  actions: [pull, push]
+`
+
+func Test_compilePattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		input   string
+		want    bool
+	}{
+		{name: "exact", pattern: "test", input: "test", want: true},
+		{name: "exact mismatch", pattern: "test", input: "testing", want: false},
+		{name: "single segment", pattern: "ci/*", input: "ci/app", want: true},
+		{name: "single segment nested", pattern: "ci/*", input: "ci/app/sub", want: false},
+		{name: "single segment prefix", pattern: "ci/*", input: "cic/app", want: false},
+		{name: "any depth", pattern: "ci/**", input: "ci/app/sub", want: true},
+		{name: "everything", pattern: "**", input: "a/b/c", want: true},
+		{name: "single character", pattern: "app?", input: "app1", want: true},
+		{name: "meta characters", pattern: "app.name", input: "appxname", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pattern, err := compilePattern(tt.pattern)
+			if err != nil {
+				t.Fatalf("compilePattern() error = %v", err)
+			}
+			if got := pattern.MatchString(tt.input); got != tt.want {
+				t.Errorf("compilePattern(%s).MatchString(%s) = %v, want %v", tt.pattern, tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseACL_Invalid(t *testing.T) {
+	if _, err := ParseACL([]byte("- users: [ci]\n  repositories: [\"ci/*\"]\n")); err == nil {
+		t.Errorf("ParseACL() expected error for entry without actions")
+	}
+	if _, err := ParseACL([]byte("- user: [ci]\n  actions: [pull]\n")); err == nil {
+		t.Errorf("ParseACL() expected error for unknown field")
+	}
+}
+
+func TestServer_AuthorizeACL(t *testing.T) {
+	acl, err := ParseACL([]byte(testACL))
+	if err != nil {
+		t.Fatalf("ParseACL() error = %v", err)
+	}
+	tests := []struct {
+		name               string
+		publicPrefixes     []string
+		user               string
+		groups             []string
+		validCredentials   bool
+		requested          *token.ResourceActions
+		wantApprovedScopes []*token.ResourceActions
+	}{
+		{
+			name:             "CI push to ci",
+			user:             "ci",
+			validCredentials: true,
+			requested:        &token.ResourceActions{Type: "repository", Name: "ci/app", Actions: []string{"pull", "push"}},
+			wantApprovedScopes: []*token.ResourceActions{
+				{Type: "repository", Name: "ci/app", Actions: []string{"pull", "push"}},
+			},
+		},
+		{
+			name:             "CI delete in ci",
+			user:             "ci",
+			validCredentials: true,
+			requested:        &token.ResourceActions{Type: "repository", Name: "ci/app", Actions: []string{"delete", "pull"}},
+			wantApprovedScopes: []*token.ResourceActions{
+				{Type: "repository", Name: "ci/app", Actions: []string{"pull"}},
+			},
+		},
+		{
+			name:               "CI push elsewhere",
+			user:               "ci",
+			validCredentials:   true,
+			requested:          &token.ResourceActions{Type: "repository", Name: "prod/app", Actions: []string{"pull", "push"}},
+			wantApprovedScopes: []*token.ResourceActions{},
+		},
+		{
+			name:             "CI push to public",
+			publicPrefixes:   []string{"prod"},
+			user:             "ci",
+			validCredentials: true,
+			requested:        &token.ResourceActions{Type: "repository", Name: "prod/app", Actions: []string{"pull", "push"}},
+			wantApprovedScopes: []*token.ResourceActions{
+				{Type: "repository", Name: "prod/app", Actions: []string{"pull"}},
+			},
+		},
+		{
+			name:             "Human full access",
+			user:             "greboid",
+			validCredentials: true,
+			requested:        &token.ResourceActions{Type: "repository", Name: "prod/app/sub", Actions: []string{"pull", "push", "delete"}},
+			wantApprovedScopes: []*token.ResourceActions{
+				{Type: "repository", Name: "prod/app/sub", Actions: []string{"pull", "push", "delete"}},
+			},
+		},
+		{
+			name:             "Wildcard user",
+			user:             "someone",
+			validCredentials: true,
+			requested:        &token.ResourceActions{Type: "repository", Name: "shared/app", Actions: []string{"pull", "push"}},
+			wantApprovedScopes: []*token.ResourceActions{
+				{Type: "repository", Name: "shared/app", Actions: []string{"pull"}},
+			},
+		},
+		{
+			name:             "Group member",
+			user:             "someone",
+			groups:           []string{"developers", "release"},
+			validCredentials: true,
+			requested:        &token.ResourceActions{Type: "repository", Name: "prod/app", Actions: []string{"pull", "push"}},
+			wantApprovedScopes: []*token.ResourceActions{
+				{Type: "repository", Name: "prod/app", Actions: []string{"pull", "push"}},
+			},
+		},
+		{
+			name:               "Not group member",
+			user:               "someone",
+			groups:             []string{"developers"},
+			validCredentials:   true,
+			requested:          &token.ResourceActions{Type: "repository", Name: "prod/app", Actions: []string{"pull", "push"}},
+			wantApprovedScopes: []*token.ResourceActions{},
+		},
+		{
+			name:               "Registry catalog",
+			user:               "ci",
+			validCredentials:   true,
+			requested:          &token.ResourceActions{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+			wantApprovedScopes: []*token.ResourceActions{},
+		},
+		{
+			name:               "Invalid credentials",
+			user:               "greboid",
+			validCredentials:   false,
+			requested:          &token.ResourceActions{Type: "repository", Name: "ci/app", Actions: []string{"pull"}},
+			wantApprovedScopes: []*token.ResourceActions{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := &Request{
+				User:             tt.user,
+				Groups:           tt.groups,
+				RequestedScope:   []*token.ResourceActions{tt.requested},
+				validCredentials: tt.validCredentials,
+			}
+			got, err := authorise(NewAuthorizer(tt.publicPrefixes, acl, nil, nil), tt.publicPrefixes, request)
+			if err != nil {
+				t.Fatalf("authorise() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.wantApprovedScopes) {
+				t.Errorf("authorise() = %v, want %v", actionsToString(got), actionsToString(tt.wantApprovedScopes))
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	AdminGroup = flag.String("admin-group", "", "Group whose members can use the admin endpoints, the endpoints are disabled if not set")
+)
+
+// RevokeRequest revokes a single token by ID and/or every token for a subject issued at or before a time, which
+// defaults to now
+type RevokeRequest struct {
+	JTI     string     `json:"jti"`
+	Subject string     `json:"subject"`
+	Before  *time.Time `json:"before"`
+}
+
+// UnlockRequest clears the failed logins of a user and/or client IP
+type UnlockRequest struct {
+	User string `json:"user"`
+	IP   string `json:"ip"`
+}
+
+// ValidateResponse describes a token checked by the validate endpoint
+type ValidateResponse struct {
+	Active bool           `json:"active"`
+	Claims *ClaimSetBodge `json:"claims,omitempty"`
+}
+
+func (s *Server) addAdminRoutes() {
+	s.Router.Path("/validate").HandlerFunc(s.HandleValidate).Methods(http.MethodGet, http.MethodPost)
+	if s.AdminGroup == "" {
+		return
+	}
+	log.Infof("Enabling admin endpoints for group: %s", s.AdminGroup)
+	admin := s.Router.PathPrefix("/admin").Subrouter()
+	admin.Use(s.requireAdmin)
+	admin.Path("/revoke").HandlerFunc(s.HandleRevoke).Methods(http.MethodPost)
+	admin.Path("/unlock").HandlerFunc(s.HandleUnlock).Methods(http.MethodPost)
+}
+
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		user, password, ok := request.BasicAuth()
+		authRequest := &Request{User: user, Password: password, ClientIP: clientIP(request, s.TrustedProxies)}
+		if ok {
+			err := s.authenticateRequest(authRequest, s.defaultRegistry())
+			if err != nil {
+				writeTooManyRequests(writer, err)
+				return
+			}
+		}
+		if !authRequest.validCredentials || authRequest.apiToken != nil {
+			writer.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			http.Error(writer, "authentication failed", http.StatusUnauthorized)
+			return
+		}
+		if !slices.Contains(authRequest.Groups, s.AdminGroup) {
+			log.Infof("Admin access denied: %s", user)
+			http.Error(writer, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+func (s *Server) HandleRevoke(writer http.ResponseWriter, request *http.Request) {
+	revokeRequest := &RevokeRequest{}
+	err := json.NewDecoder(request.Body).Decode(revokeRequest)
+	if err != nil {
+		http.Error(writer, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if revokeRequest.JTI == "" && revokeRequest.Subject == "" {
+		http.Error(writer, "jti or subject is required", http.StatusBadRequest)
+		return
+	}
+	if revokeRequest.JTI != "" {
+		err = s.Revocations.RevokeJTI(revokeRequest.JTI)
+		if err != nil {
+			log.Errorf("Unable to save revocation: %s", err)
+			http.Error(writer, "unable to save revocation", http.StatusInternalServerError)
+			return
+		}
+	}
+	if revokeRequest.Subject != "" {
+		before := time.Now()
+		if revokeRequest.Before != nil {
+			before = *revokeRequest.Before
+		}
+		err = s.Revocations.RevokeSubject(revokeRequest.Subject, before)
+		if err != nil {
+			log.Errorf("Unable to save revocation: %s", err)
+			http.Error(writer, "unable to save revocation", http.StatusInternalServerError)
+			return
+		}
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) HandleUnlock(writer http.ResponseWriter, request *http.Request) {
+	unlockRequest := &UnlockRequest{}
+	err := json.NewDecoder(request.Body).Decode(unlockRequest)
+	if err != nil {
+		http.Error(writer, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if unlockRequest.User == "" && unlockRequest.IP == "" {
+		http.Error(writer, "user or ip is required", http.StatusBadRequest)
+		return
+	}
+	s.Lockouts.Clear(strings.ToLower(unlockRequest.User), unlockRequest.IP)
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// HandleValidate checks a bearer token was issued by this server, is in date and has not been revoked, optionally
+// checking it was issued for the given service
+func (s *Server) HandleValidate(writer http.ResponseWriter, request *http.Request) {
+	tokenString := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if tokenString == "" || tokenString == request.Header.Get("Authorization") {
+		tokenString = request.FormValue("token")
+	}
+	claims, err := s.verifyToken(tokenString)
+	if err == nil && request.FormValue("service") != "" && claims.Audience != request.FormValue("service") {
+		err = errTokenService
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	if err != nil {
+		log.Debugf("Token validation failed: %s", err)
+		writer.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(writer).Encode(&ValidateResponse{Active: false})
+		return
+	}
+	_ = json.NewEncoder(writer).Encode(&ValidateResponse{Active: true, Claims: claims})
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/greboid/registryauth/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	AuditLogPath = flag.String("audit-log", "", "File to append a JSON line to for every token request, - writes to stdout, disabled if not set")
+)
+
+// Reasons recorded in the audit log for the outcome of a token request
+const (
+	auditGranted              = "granted"
+	auditPartiallyGranted     = "partially granted"
+	auditDenied               = "denied"
+	auditAuthenticated        = "authenticated"
+	auditAuthenticationFailed = "authentication failed"
+	auditInvalidRequest       = "invalid request"
+	auditInvalidRefreshToken  = "invalid refresh token"
+	auditUnknownService       = "unknown service"
+	auditRateLimited          = "rate limited"
+	auditLockedOut            = "locked out"
+	auditError                = "error"
+)
+
+// AuditEvent records the outcome of a single token request
+type AuditEvent struct {
+	Time            time.Time `json:"time"`
+	ClientIP        string    `json:"client_ip"`
+	User            string    `json:"user"`
+	Authenticated   bool      `json:"authenticated"`
+	Service         string    `json:"service"`
+	ClientID        string    `json:"client_id,omitempty"`
+	RequestedScopes []string  `json:"requested_scopes"`
+	ApprovedScopes  []string  `json:"approved_scopes"`
+	Reason          string    `json:"reason"`
+	JTI             string    `json:"jti,omitempty"`
+}
+
+// AuditLog writes an event for every token request as a line of JSON, a nil log records nothing
+type AuditLog struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+// NewAuditLog appends to the file at path, or writes to stdout if path is -
+func NewAuditLog(path string) (*AuditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if path == "-" {
+		return &AuditLog{writer: os.Stdout}, nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{writer: file}, nil
+}
+
+func (a *AuditLog) Record(event *AuditEvent) {
+	if a == nil {
+		return
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("Unable to encode audit event: %s", err)
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, err = a.writer.Write(append(line, '\n'))
+	if err != nil {
+		log.Errorf("Unable to write audit event: %s", err)
+	}
+}
+
+// audit records the outcome of a token request in the metrics and audit log, the auth request is nil if the request
+// was rejected before it was parsed
+func (s *Server) audit(request *http.Request, authRequest *Request, reason string) {
+	recordOutcome(authRequest, reason)
+	if s.Audit == nil {
+		return
+	}
+	if authRequest == nil {
+		authRequest = &Request{
+			Service:        parseRequestService(request),
+			ClientID:       request.FormValue("client_id"),
+			ClientIP:       clientIP(request, s.TrustedProxies),
+			RequestedScope: parseScope(parseRequestScope(request)),
+		}
+		authRequest.User, _ = getAuth(request)
+	}
+	s.Audit.Record(&AuditEvent{
+		Time:            time.Now().UTC(),
+		ClientIP:        authRequest.ClientIP,
+		User:            authRequest.User,
+		Authenticated:   authRequest.validCredentials,
+		Service:         authRequest.Service,
+		ClientID:        authRequest.ClientID,
+		RequestedScopes: scopeStrings(authRequest.RequestedScope),
+		ApprovedScopes:  scopeStrings(authRequest.ApprovedScope),
+		Reason:          reason,
+		JTI:             authRequest.jti,
+	})
+}
+
+// recordOutcome counts the request by outcome, and the actions approved if a token was issued with any
+func recordOutcome(authRequest *Request, reason string) {
+	switch reason {
+	case auditGranted, auditPartiallyGranted, auditAuthenticated:
+		for _, scope := range authRequest.ApprovedScope {
+			for _, action := range scope.Actions {
+				metrics.ApprovedActions.WithLabelValues(action).Inc()
+			}
+		}
+		if authRequest.validCredentials {
+			metrics.AuthRequests.WithLabelValues("authenticated").Inc()
+		} else {
+			metrics.AuthRequests.WithLabelValues("anonymous").Inc()
+		}
+	case auditError:
+		metrics.AuthRequests.WithLabelValues("error").Inc()
+	default:
+		metrics.AuthRequests.WithLabelValues("denied").Inc()
+	}
+}
+
+// grantReason describes how much of the requested scope a request was issued a token for
+func grantReason(request *Request) string {
+	switch {
+	case len(request.RequestedScope) == 0:
+		return auditAuthenticated
+	case len(request.ApprovedScope) == 0:
+		return auditDenied
+	case formatScope(request.ApprovedScope) == formatScope(request.RequestedScope):
+		return auditGranted
+	default:
+		return auditPartiallyGranted
+	}
+}
+
+// throttledReason describes why a request was rejected by a rate limit or lockout
+func throttledReason(err error) string {
+	var locked *LockedError
+	if errors.As(err, &locked) {
+		return auditLockedOut
+	}
+	return auditRateLimited
+}
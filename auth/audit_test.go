@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/greboid/registryauth/metrics"
+)
+
+func TestServer_HandleAuthAudit(t *testing.T) {
+	tests := []struct {
+		name          string
+		service       string
+		scope         string
+		user          string
+		password      string
+		wantReason    string
+		wantApproved  string
+		wantAuthed    bool
+		wantJTI       bool
+		wantRequested int
+	}{
+		{name: "Anonymous public pull", service: "service", scope: "repository:public/app:pull", wantReason: auditGranted, wantApproved: "repository:public/app:pull", wantJTI: true, wantRequested: 1},
+		{name: "Anonymous public push", service: "service", scope: "repository:public/app:pull,push", wantReason: auditPartiallyGranted, wantApproved: "repository:public/app:pull", wantJTI: true, wantRequested: 1},
+		{name: "Anonymous private pull", service: "service", scope: "repository:private/app:pull", wantReason: auditDenied, wantJTI: true, wantRequested: 1},
+		{name: "Login", service: "service", user: "test", password: "test", wantReason: auditAuthenticated, wantAuthed: true, wantJTI: true},
+		{name: "Failed login", service: "service", user: "test", password: "wrong", wantReason: auditAuthenticationFailed},
+		{name: "Unknown service", service: "unknown", scope: "repository:public/app:pull", wantReason: auditUnknownService, wantRequested: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			server := newTestServer(t)
+			server.Audit = &AuditLog{writer: output}
+			query := url.Values{"service": {tt.service}, "scope": {tt.scope}}
+			request := httptest.NewRequest(http.MethodGet, "/auth?"+query.Encode(), nil)
+			request.RemoteAddr = "1.2.3.4:1234"
+			if tt.user != "" {
+				request.SetBasicAuth(tt.user, tt.password)
+			}
+			server.HandleAuth(httptest.NewRecorder(), request)
+			event := &AuditEvent{}
+			if err := json.Unmarshal(output.Bytes(), event); err != nil {
+				t.Fatalf("unable to parse audit event %q: %v", output.String(), err)
+			}
+			if event.Reason != tt.wantReason {
+				t.Errorf("audit reason = %s, want %s", event.Reason, tt.wantReason)
+			}
+			if strings.Join(event.ApprovedScopes, " ") != tt.wantApproved {
+				t.Errorf("audit approved scopes = %v, want %s", event.ApprovedScopes, tt.wantApproved)
+			}
+			if len(event.RequestedScopes) != tt.wantRequested {
+				t.Errorf("audit requested scopes = %v, want %d", event.RequestedScopes, tt.wantRequested)
+			}
+			if event.Authenticated != tt.wantAuthed || event.User != tt.user || event.Service != tt.service || event.ClientIP != "1.2.3.4" {
+				t.Errorf("audit event = %+v", event)
+			}
+			if (event.JTI != "") != tt.wantJTI {
+				t.Errorf("audit jti = %s, want jti %v", event.JTI, tt.wantJTI)
+			}
+		})
+	}
+}
+
+func TestNewAuditLog(t *testing.T) {
+	if auditLog, err := NewAuditLog(""); auditLog != nil || err != nil {
+		t.Errorf("NewAuditLog() with no path = %v, %v, want nil", auditLog, err)
+	}
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := NewAuditLog(path)
+	if err != nil {
+		t.Fatalf("NewAuditLog() error = %v", err)
+	}
+	auditLog.Record(&AuditEvent{User: "first"})
+	auditLog.Record(&AuditEvent{User: "second"})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"user":"second"`) {
+		t.Errorf("audit log = %s, want 2 lines", data)
+	}
+}
+
+func TestServer_HandleAuthMetrics(t *testing.T) {
+	server := newTestServer(t)
+	request := httptest.NewRequest(http.MethodGet, "/auth?service=service&scope=repository:public/app:pull", nil)
+	server.HandleAuth(httptest.NewRecorder(), request)
+	request = httptest.NewRequest(http.MethodGet, "/auth?service=unknown", nil)
+	server.HandleAuth(httptest.NewRecorder(), request)
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`registryauth_auth_requests_total{outcome="anonymous"}`,
+		`registryauth_auth_requests_total{outcome="denied"}`,
+		`registryauth_approved_actions_total{action="pull"}`,
+		`registryauth_signing_duration_seconds_count`,
+	} {
+		if !strings.Contains(recorder.Body.String(), want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
+
+func Test_recordOutcome(t *testing.T) {
+	tests := []struct {
+		name        string
+		request     *Request
+		reason      string
+		wantOutcome string
+	}{
+		{name: "Granted", request: &Request{}, reason: auditGranted, wantOutcome: "anonymous"},
+		{name: "Authenticated", request: &Request{validCredentials: true}, reason: auditAuthenticated, wantOutcome: "authenticated"},
+		{name: "Nothing approved", request: &Request{validCredentials: true}, reason: auditDenied, wantOutcome: "denied"},
+		{name: "Failed login", request: &Request{}, reason: auditAuthenticationFailed, wantOutcome: "denied"},
+		{name: "Error", request: &Request{}, reason: auditError, wantOutcome: "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := authRequestCount(t, tt.wantOutcome)
+			recordOutcome(tt.request, tt.reason)
+			if got := authRequestCount(t, tt.wantOutcome) - before; got != 1 {
+				t.Errorf("recordOutcome() counted %v %s requests, want 1", got, tt.wantOutcome)
+			}
+		})
+	}
+}
+
+func authRequestCount(t *testing.T, outcome string) float64 {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	prefix := `registryauth_auth_requests_total{outcome="` + outcome + `"} `
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, prefix); ok {
+			count, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("unable to parse metric %q: %v", line, err)
+			}
+			return count
+		}
+	}
+	return 0
+}
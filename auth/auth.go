@@ -2,20 +2,30 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/distribution/distribution/v3/registry/auth/token"
 	"github.com/docker/libtrust"
+	"github.com/greboid/registryauth/metrics"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
 )
 
 var (
-	PublicPrefixes = flag.String("public", "", "prefixes of public readable folders")
+	PublicPrefixes = flag.String("public", "", "Comma separated prefixes, globs or ~regexes of public readable repositories, prefix with ! to exclude matching repositories and everything nested under them")
 	UserInput      = flag.String("users", "", "Yaml formatted list of users")
+	GroupInput     = flag.String("groups", "", "Yaml formatted map of groups to their members")
 	Realm          = flag.String("realm", "Registry", "Realm for the registry")
 	Issuer         = flag.String("issuer", "Registry", "Issuer for the registry")
 	Service        = flag.String("service", "Registry", "Service name for the registry")
@@ -24,22 +34,45 @@ var (
 type Request struct {
 	User             string
 	Password         string
+	Groups           []string
 	Service          string
 	ApprovedScope    []*token.ResourceActions
 	RequestedScope   []*token.ResourceActions
+	ClientID         string
+	RemoteAddr       string
+	ClientIP         string
+	UserAgent        string
 	validCredentials bool
+	apiToken         *APIToken
+	refreshable      bool
+	jti              string
 }
 
+// Response is the token response defined by the distribution token spec, token is duplicated as access_token for
+// OAuth2 compatible clients
 type Response struct {
-	Success bool
-	Token   string `json:"token"`
+	Token        string `json:"token"`
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	IssuedAt     string `json:"issued_at"`
+	Scope        string `json:"scope,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
 func (s *Server) GetFullAccessToken(repository ...string) (string, error) {
+	return s.GetServiceAccessToken(s.Service, repository...)
+}
+
+// GetServiceAccessToken returns a token for the service with full access to its catalog and the given repositories
+func (s *Server) GetServiceAccessToken(service string, repository ...string) (string, error) {
+	registry := s.registry(service)
+	if registry == nil {
+		return "", fmt.Errorf("unknown service: %s", service)
+	}
 	authRequest := &Request{
 		User:     "internal",
 		Password: "",
-		Service:  s.Service,
+		Service:  registry.Service,
 		ApprovedScope: []*token.ResourceActions{
 			{
 				Type:    "registry",
@@ -56,7 +89,7 @@ func (s *Server) GetFullAccessToken(repository ...string) (string, error) {
 			Actions: []string{"*"},
 		})
 	}
-	authToken, err := authRequest.getResponseToken(s.publicKey, s.privateKey, s.Issuer)
+	authToken, err := authRequest.getResponseToken(registry.publicKey, registry.privateKey, registry.Issuer, registry.TokenLifetimes.forRequest(authRequest), time.Now())
 	if err != nil {
 		return "", err
 	}
@@ -64,39 +97,73 @@ func (s *Server) GetFullAccessToken(repository ...string) (string, error) {
 }
 
 func (s *Server) HandleAuth(writer http.ResponseWriter, request *http.Request) {
-	authRequest := parseRequest(s.Users, request)
-	err := authRequest.getApprovedScope(s.PublicPrefixes)
+	if isOAuthRequest(request) {
+		s.HandleOAuth(writer, request)
+		return
+	}
+	registry, err := s.registryFor(parseRequestService(request))
+	if err != nil {
+		log.Infof("Rejecting token request: %s", err)
+		s.audit(request, nil, auditUnknownService)
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	authRequest, err := s.parseRequest(request, registry)
 	if err != nil {
-		request.Header.Set("WWW-authenticate", fmt.Sprintf(`Basic realm="%s"`, s.Realm))
+		s.audit(request, nil, throttledReason(err))
+		writeTooManyRequests(writer, err)
+		return
+	}
+	authRequest.Service = registry.Service
+	err = authRequest.getApprovedScope(registry.Authorizer, registry.PublicPrefixes)
+	if errors.Is(err, errAuthenticationFailed) {
+		s.audit(request, authRequest, auditAuthenticationFailed)
+		writer.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, s.Realm))
 		http.Error(writer, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	jwtToken, err := authRequest.getToken(s.publicKey, s.privateKey, s.Issuer)
 	if err != nil {
+		s.audit(request, authRequest, auditError)
+		http.Error(writer, "authorise failed", http.StatusServiceUnavailable)
+		return
+	}
+	jwtToken, err := authRequest.getToken(registry.publicKey, registry.privateKey, registry.Issuer, registry.TokenLifetimes.forRequest(authRequest))
+	if err != nil {
+		s.audit(request, authRequest, auditError)
 		http.Error(writer, "authorise failed", http.StatusInternalServerError)
+		return
 	}
+	s.audit(request, authRequest, grantReason(authRequest))
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
 	_, _ = writer.Write(jwtToken)
 }
 
-func (r *Request) getApprovedScope(publicPrefixes []string) error {
+var (
+	errAuthenticationFailed = errors.New("authentication failed")
+)
+
+// getApprovedScope sets the scope the authorizer approves, returning errAuthenticationFailed for a login without valid
+// credentials or the authorizer's error if it couldn't decide
+func (r *Request) getApprovedScope(authorizer Authorizer, publicPrefixes []string) error {
 	if len(r.RequestedScope) > 0 {
-		approvedScope, err := authorise(publicPrefixes, r)
-		if err == nil {
-			r.ApprovedScope = approvedScope
-		} else {
-			log.Infof("authorise failed: %s", err)
+		approvedScope, err := authorise(authorizer, publicPrefixes, r)
+		if err != nil {
+			log.Errorf("authorise failed: %s", err)
+			return err
 		}
+		r.ApprovedScope = approvedScope
 	} else {
 		if !r.validCredentials {
 			log.Infof("authenticate failed: %s", r.User)
-			return fmt.Errorf("authentication failed")
+			return errAuthenticationFailed
 		}
 	}
 	return nil
 }
 
-func (r *Request) getResponseToken(publicKey libtrust.PublicKey, privateKey libtrust.PrivateKey, issuer string) (string, error) {
-	responseToken, err := CreateToken(publicKey, privateKey, issuer, r)
+func (r *Request) getResponseToken(publicKey libtrust.PublicKey, privateKey libtrust.PrivateKey, issuer string, lifetime TokenLifetime, issuedAt time.Time) (string, error) {
+	responseToken, err := CreateToken(publicKey, privateKey, issuer, lifetime, issuedAt, r)
 	if err != nil {
 		log.Errorf("Unable to create token: %s", err)
 		return "", err
@@ -104,31 +171,97 @@ func (r *Request) getResponseToken(publicKey libtrust.PublicKey, privateKey libt
 	return responseToken, nil
 }
 
-func (r *Request) getToken(publicKey libtrust.PublicKey, privateKey libtrust.PrivateKey, issuer string) ([]byte, error) {
-	responseToken, err := r.getResponseToken(publicKey, privateKey, issuer)
+func (r *Request) getToken(publicKey libtrust.PublicKey, privateKey libtrust.PrivateKey, issuer string, lifetime TokenLifetime) ([]byte, error) {
+	issuedAt := time.Now()
+	responseToken, err := r.getResponseToken(publicKey, privateKey, issuer, lifetime, issuedAt)
 	if err != nil {
 		log.Errorf("Unable to create token: %s", err)
 		return nil, err
 	}
-	//Bodge access_token and token to support old clients, but not sure if I care
-	result, _ := json.Marshal(&map[string]string{"access_token": responseToken, "token": responseToken})
-	return result, nil
+	return json.Marshal(&Response{
+		Token:       responseToken,
+		AccessToken: responseToken,
+		ExpiresIn:   int(lifetime.Expiry.Seconds()),
+		IssuedAt:    issuedAt.UTC().Format(time.RFC3339),
+	})
 }
 
-func parseRequest(users map[string]string, request *http.Request) *Request {
+// parseRequest parses and authenticates a token request, failing if the user or client is rate limited or locked out
+func (s *Server) parseRequest(request *http.Request, registry *Registry) (*Request, error) {
 	authRequest := &Request{}
 	authRequest.User, authRequest.Password = getAuth(request)
 	authRequest.Service = parseRequestService(request)
+	authRequest.ClientID = request.FormValue("client_id")
+	authRequest.RemoteAddr = request.RemoteAddr
+	authRequest.ClientIP = clientIP(request, s.TrustedProxies)
+	authRequest.UserAgent = request.UserAgent()
 	scopeString := parseRequestScope(request)
 	authRequest.RequestedScope = parseScope(scopeString)
-	authRequest.validCredentials = authenticate(users, authRequest)
-	log.Debugf("Auth request - User: %s, Service: %s, RawScope: %s, ValidCreds: %v",
-		authRequest.User, authRequest.Service, scopeString, authRequest.validCredentials)
+	err := s.RateLimits.Allow(authRequest.User, authRequest.ClientIP)
+	if err == nil {
+		err = s.authenticateRequest(authRequest, registry)
+	}
+	if err != nil {
+		log.Infof("Rejecting token request - User: %s, IP: %s: %s", authRequest.User, authRequest.ClientIP, err)
+		return nil, err
+	}
+	log.Debugf("Auth request - User: %s, Groups: %v, Service: %s, RawScope: %s, ValidCreds: %v",
+		authRequest.User, authRequest.Groups, authRequest.Service, scopeString, authRequest.validCredentials)
 	for _, scope := range authRequest.RequestedScope {
 		log.Debugf("Requested scope - Type: %s, Name: %s, Class: %s, Actions: %v",
 			scope.Type, scope.Name, scope.Class, scope.Actions)
 	}
-	return authRequest
+	return authRequest, nil
+}
+
+// authenticateRequest checks the request's credentials against the service's authenticators and then the top level
+// ones, adding the user's configured groups to any the authenticator returned. Credentials aren't checked at all
+// while the user or client is locked out, and failures count towards a lockout whatever the case of the username.
+func (s *Server) authenticateRequest(authRequest *Request, registry *Registry) error {
+	if authRequest.User == "" && authRequest.Password == "" {
+		return nil
+	}
+	lockoutUser := strings.ToLower(authRequest.User)
+	err := s.Lockouts.Attempt(lockoutUser, authRequest.ClientIP)
+	if err != nil {
+		return err
+	}
+	identity, _ := s.authenticators(registry).Authenticate(authRequest.User, authRequest.Password)
+	if identity == nil {
+		s.Lockouts.Failed(lockoutUser, authRequest.ClientIP)
+		return nil
+	}
+	s.Lockouts.Succeeded(lockoutUser, authRequest.ClientIP)
+	authRequest.setIdentity(identity, s.Groups)
+	return nil
+}
+
+// writeTooManyRequests responds to a request from a locked out or rate limited user or client
+func writeTooManyRequests(writer http.ResponseWriter, err error) {
+	writer.Header().Set("Retry-After", retryAfter(err))
+	http.Error(writer, err.Error(), http.StatusTooManyRequests)
+}
+
+func retryAfter(err error) string {
+	var locked *LockedError
+	if errors.As(err, &locked) {
+		return strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds())))
+	}
+	var limited *RateLimitedError
+	if errors.As(err, &limited) {
+		return strconv.Itoa(int(math.Ceil(limited.RetryAfter.Seconds())))
+	}
+	return "1"
+}
+
+// setIdentity marks the request as authenticated as the identity, using the identity's username as backends may match
+// the username entered case insensitively
+func (r *Request) setIdentity(identity *Identity, groups map[string][]string) {
+	r.validCredentials = true
+	r.User = identity.User
+	r.apiToken = identity.Token
+	r.refreshable = identity.refreshable
+	r.Groups = mergeGroups(groupsForUser(groups, identity.User), identity.Groups)
 }
 
 func parseRequestScope(request *http.Request) string {
@@ -188,28 +321,99 @@ func authenticate(users map[string]string, request *Request) bool {
 	if !ok {
 		return false
 	}
-	return bcrypt.CompareHashAndPassword([]byte(password), []byte(request.Password)) == nil
+	return checkPassword(password, request.Password)
+}
+
+// checkPassword compares a password with a bcrypt hash
+func checkPassword(hash string, password string) bool {
+	defer metrics.ObserveSince(metrics.BcryptDuration, time.Now())
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func groupsForUser(groups map[string][]string, user string) []string {
+	var memberOf []string
+	for group, members := range groups {
+		for _, member := range members {
+			if member == user {
+				memberOf = append(memberOf, group)
+				break
+			}
+		}
+	}
+	sort.Strings(memberOf)
+	return memberOf
+}
+
+func mergeGroups(groups []string, extraGroups []string) []string {
+	for _, group := range extraGroups {
+		if !slices.Contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	sort.Strings(groups)
+	return groups
 }
 
+// IsScopePublic checks a repository against the public patterns, it is public if any pattern matches it and no
+// exclusion does
 func IsScopePublic(publicPrefixes []string, scopeItem *token.ResourceActions) bool {
 	if scopeItem.Type != "repository" {
 		return false
 	}
+	public := false
 	for _, publicPrefix := range publicPrefixes {
-		if publicPrefix == "" {
+		if publicPrefix == "" || publicPrefix == "!" {
 			continue
 		}
-		var folderPrefix string
-		if publicPrefix == "/" {
-			folderPrefix = ""
-		} else {
-			folderPrefix = publicPrefix
+		exclusion := strings.HasPrefix(publicPrefix, "!")
+		pattern, err := compilePublicPattern(publicPrefix)
+		if err != nil {
+			log.Debugf("Ignoring invalid public pattern %s: %s", publicPrefix, err)
+			continue
 		}
-		if strings.HasPrefix(scopeItem.Name, folderPrefix) {
-			return true
+		if pattern.MatchString(scopeItem.Name) {
+			if exclusion {
+				return false
+			}
+			public = true
 		}
 	}
-	return false
+	return public
+}
+
+// publicPatterns caches compiled public patterns, as the same few are checked for every requested scope
+var publicPatterns sync.Map
+
+// compilePublicPattern converts a public pattern into a regexp. "/" matches everything, patterns starting with "~" are
+// regexes, patterns containing "*" or "?" are repository globs, and anything else is a prefix matching whole path
+// segments so "lib" matches "lib/app" but not "library". Exclusions, starting with "!", also match every repository
+// nested under what they match, so "!team/secret/*" excludes "team/secret/a/b" as well as "team/secret/a".
+func compilePublicPattern(publicPattern string) (*regexp.Regexp, error) {
+	if cached, ok := publicPatterns.Load(publicPattern); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+	unprefixed, exclusion := strings.CutPrefix(publicPattern, "!")
+	var expression, nested string
+	switch {
+	case unprefixed == "/":
+		expression = ".*"
+	case strings.HasPrefix(unprefixed, "~"):
+		expression = "(?:" + strings.TrimPrefix(unprefixed, "~") + ")"
+	case strings.ContainsAny(unprefixed, "*?"):
+		expression = globToRegexp(strings.TrimPrefix(unprefixed, "/"))
+	default:
+		expression = regexp.QuoteMeta(strings.Trim(unprefixed, "/"))
+		nested = "(/.*)?"
+	}
+	if exclusion {
+		nested = "(/.*)?"
+	}
+	pattern, err := regexp.Compile("^" + expression + nested + "$")
+	if err != nil {
+		return nil, err
+	}
+	publicPatterns.Store(publicPattern, pattern)
+	return pattern, nil
 }
 
 func sanitiseScope(scope *token.ResourceActions, isPublic bool, validCredentials bool) *token.ResourceActions {
@@ -237,13 +441,19 @@ func sanitiseScope(scope *token.ResourceActions, isPublic bool, validCredentials
 	return newScope
 }
 
-func authorise(publicPrefixes []string, request *Request) ([]*token.ResourceActions, error) {
-	approvedScopes := make([]*token.ResourceActions, 0)
-	for _, scopeItem := range request.RequestedScope {
-		if scope := sanitiseScope(scopeItem, IsScopePublic(publicPrefixes, scopeItem), request.validCredentials); scope != nil {
-			log.Debugf("Approving scope: %s", scope)
-			approvedScopes = append(approvedScopes, scope)
-		}
+// authorise passes the requested scopes through the authorizer, then applies the restrictions of any API token used
+func authorise(authorizer Authorizer, publicPrefixes []string, request *Request) ([]*token.ResourceActions, error) {
+	approvedScopes, err := authorizer.Authorize(request, request.RequestedScope)
+	if err != nil {
+		return nil, err
+	}
+	if request.apiToken != nil {
+		approvedScopes = filterScopes(approvedScopes, func(scope *token.ResourceActions) *token.ResourceActions {
+			return request.apiToken.restrict(scope, IsScopePublic(publicPrefixes, scope))
+		})
+	}
+	for _, scope := range approvedScopes {
+		log.Debugf("Approving scope: %s", scope)
 	}
 	return approvedScopes, nil
 }
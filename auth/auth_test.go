@@ -2,16 +2,39 @@ package auth
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3/registry/auth/token"
+	"github.com/docker/libtrust"
 )
 
+const testPasswordHash = "$2a$07$N/0tVCSbMg.igieLxDNYyOhjJxEIHec1ia01Wgr6jNk4gZwgUUlWq"
+
+func newTestServer(t *testing.T) *Server {
+	privateKey, err := libtrust.GenerateRSA2048PrivateKey()
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	return &Server{
+		publicKey:      privateKey.PublicKey(),
+		privateKey:     privateKey,
+		Authenticators: AuthenticatorChain{NewStaticAuthenticator(map[string]string{"test": testPasswordHash})},
+		PublicPrefixes: []string{"public"},
+		Authorizer:     NewAuthorizer([]string{"public"}, nil, nil, nil),
+		Issuer:         "issuer",
+		Service:        "service",
+		Realm:          "realm",
+	}
+}
+
 func actionsToString(a []*token.ResourceActions) string {
 	if a == nil {
 		return "nil"
@@ -175,7 +198,7 @@ func TestServer_Authorize(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotApprovedScopes, err := authorise(tt.publicPrefixes, tt.request)
+			gotApprovedScopes, err := authorise(NewAuthorizer(tt.publicPrefixes, nil, nil, nil), tt.publicPrefixes, tt.request)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("authorise() error = %#v, wantErr %#v", err, tt.wantErr)
 				return
@@ -565,6 +588,90 @@ func TestServer_isScopePublic(t *testing.T) {
 			scopeName:      "test",
 			want:           true,
 		},
+		{
+			name:           "Prefix matches whole segments",
+			PublicPrefixes: []string{"lib"},
+			scopeType:      "repository",
+			scopeName:      "library-private",
+			want:           false,
+		},
+		{
+			name:           "Prefix with slashes",
+			PublicPrefixes: []string{"/lib/"},
+			scopeType:      "repository",
+			scopeName:      "lib/app",
+			want:           true,
+		},
+		{
+			name:           "Glob",
+			PublicPrefixes: []string{"team/*/release"},
+			scopeType:      "repository",
+			scopeName:      "team/web/release",
+			want:           true,
+		},
+		{
+			name:           "Glob within segment",
+			PublicPrefixes: []string{"team/*/release"},
+			scopeType:      "repository",
+			scopeName:      "team/web/app/release",
+			want:           false,
+		},
+		{
+			name:           "Regex",
+			PublicPrefixes: []string{"~mirror/(alpine|debian)"},
+			scopeType:      "repository",
+			scopeName:      "mirror/debian",
+			want:           true,
+		},
+		{
+			name:           "Regex is anchored",
+			PublicPrefixes: []string{"~mirror/(alpine|debian)"},
+			scopeType:      "repository",
+			scopeName:      "mirror/debian-private",
+			want:           false,
+		},
+		{
+			name:           "Exclusion",
+			PublicPrefixes: []string{"team", "!team/secret/*"},
+			scopeType:      "repository",
+			scopeName:      "team/secret/app",
+			want:           false,
+		},
+		{
+			name:           "Exclusion of nested repository",
+			PublicPrefixes: []string{"team", "!team/secret/*"},
+			scopeType:      "repository",
+			scopeName:      "team/secret/app/cache",
+			want:           false,
+		},
+		{
+			name:           "Exclusion regex of nested repository",
+			PublicPrefixes: []string{"/", "!~mirror/(alpine|debian)"},
+			scopeType:      "repository",
+			scopeName:      "mirror/debian/cache",
+			want:           false,
+		},
+		{
+			name:           "Exclusion within segment",
+			PublicPrefixes: []string{"team", "!team/secret/*"},
+			scopeType:      "repository",
+			scopeName:      "team/secret-app",
+			want:           true,
+		},
+		{
+			name:           "Exclusion before inclusion",
+			PublicPrefixes: []string{"!team/secret/*", "/"},
+			scopeType:      "repository",
+			scopeName:      "team/secret/app",
+			want:           false,
+		},
+		{
+			name:           "Not excluded",
+			PublicPrefixes: []string{"team", "!team/secret/*"},
+			scopeType:      "repository",
+			scopeName:      "team/public/app",
+			want:           true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -578,6 +685,19 @@ func TestServer_isScopePublic(t *testing.T) {
 	}
 }
 
+func TestParsePrefixes(t *testing.T) {
+	got, err := ParsePrefixes("lib, team/*/release,!team/secret/*")
+	if err != nil {
+		t.Fatalf("ParsePrefixes() error = %v", err)
+	}
+	if want := []string{"lib", "team/*/release", "!team/secret/*"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParsePrefixes() = %v, want %v", got, want)
+	}
+	if _, err = ParsePrefixes("~team/(unclosed"); err == nil {
+		t.Errorf("ParsePrefixes() expected error for invalid regex")
+	}
+}
+
 func getBasicAuthHeader(username string, password string) string {
 	return fmt.Sprintf("Basic %s",
 		base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password))))
@@ -864,3 +984,77 @@ func Test_parseRequestScope(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_HandleAuth(t *testing.T) {
+	server := newTestServer(t)
+	server.TokenLifetimes = &TokenLifetimes{Default: TokenLifetime{Expiry: 5 * time.Minute}}
+	tests := []struct {
+		name       string
+		user       string
+		password   string
+		scope      string
+		wantStatus int
+	}{
+		{name: "Anonymous public pull", scope: "repository:public/test:pull", wantStatus: http.StatusOK},
+		{name: "Valid credentials", user: "test", password: "test", wantStatus: http.StatusOK},
+		{name: "Invalid credentials", user: "test", password: "wrong", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/auth?service=service&scope="+url.QueryEscape(tt.scope), nil)
+			if tt.user != "" {
+				request.SetBasicAuth(tt.user, tt.password)
+			}
+			recorder := httptest.NewRecorder()
+			server.HandleAuth(recorder, request)
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("HandleAuth() status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if recorder.Header().Get("WWW-Authenticate") != `Basic realm="realm"` {
+					t.Errorf("HandleAuth() WWW-Authenticate = %s", recorder.Header().Get("WWW-Authenticate"))
+				}
+				return
+			}
+			if recorder.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("HandleAuth() Content-Type = %s", recorder.Header().Get("Content-Type"))
+			}
+			response := &Response{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+				t.Fatalf("unable to parse response: %v", err)
+			}
+			if response.Token == "" || response.Token != response.AccessToken {
+				t.Errorf("HandleAuth() token = %s, access_token = %s", response.Token, response.AccessToken)
+			}
+			if response.ExpiresIn != 300 {
+				t.Errorf("HandleAuth() expires_in = %d, want 300", response.ExpiresIn)
+			}
+			if _, err := time.Parse(time.RFC3339, response.IssuedAt); err != nil {
+				t.Errorf("HandleAuth() issued_at = %s: %v", response.IssuedAt, err)
+			}
+		})
+	}
+}
+
+func Test_groupsForUser(t *testing.T) {
+	groups, err := ParseGroups("release: [alice, bob]\nadmins: [alice]\nci: [robot]\n")
+	if err != nil {
+		t.Fatalf("ParseGroups() error = %v", err)
+	}
+	tests := []struct {
+		name string
+		user string
+		want []string
+	}{
+		{name: "Multiple groups", user: "alice", want: []string{"admins", "release"}},
+		{name: "Single group", user: "bob", want: []string{"release"}},
+		{name: "No groups", user: "carol", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := groupsForUser(groups, tt.user); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("groupsForUser() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Identity is a user whose credentials have been verified by an Authenticator, along with the groups the backend
+// says they belong to
+type Identity struct {
+	User   string
+	Groups []string
+	// Token is set when the user authenticated with an API token, whose restrictions apply to every scope
+	Token       *APIToken
+	refreshable bool
+}
+
+// Authenticator verifies a username and password. A backend that doesn't recognise the credentials returns a nil
+// identity so the next backend can be tried, an error is returned for failures such as an unreachable server.
+type Authenticator interface {
+	Authenticate(user string, password string) (*Identity, error)
+}
+
+// Refresher is implemented by authenticators that can look up a user again without their password, refresh tokens
+// are only issued to users whose authenticator is a Refresher. The token name is set when the refresh token was
+// issued to an API token.
+type Refresher interface {
+	Refresh(user string, tokenName string) (*Identity, error)
+}
+
+// AuthenticatorChain tries each authenticator in order, the first to return an identity wins
+type AuthenticatorChain []Authenticator
+
+func (c AuthenticatorChain) Authenticate(user string, password string) (*Identity, error) {
+	for _, authenticator := range c {
+		identity, err := authenticator.Authenticate(user, password)
+		if err != nil {
+			log.Debugf("%T authentication failed: %s", authenticator, err)
+			continue
+		}
+		if identity != nil {
+			_, identity.refreshable = authenticator.(Refresher)
+			return identity, nil
+		}
+	}
+	return nil, nil
+}
+
+// Refresh asks each authenticator that supports refreshing to look up the user, failing if none of them know it
+func (c AuthenticatorChain) Refresh(user string, tokenName string) (*Identity, error) {
+	for _, authenticator := range c {
+		refresher, ok := authenticator.(Refresher)
+		if !ok {
+			continue
+		}
+		identity, err := refresher.Refresh(user, tokenName)
+		if err != nil {
+			log.Debugf("%T refresh failed: %s", authenticator, err)
+			continue
+		}
+		if identity != nil {
+			return identity, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown user: %s", user)
+}
+
+// StaticAuthenticator checks passwords against a map of users to bcrypt hashes, which can be swapped when the user
+// files change
+type StaticAuthenticator struct {
+	lock    sync.RWMutex
+	users   map[string]string
+	loadErr error
+}
+
+func NewStaticAuthenticator(users map[string]string) *StaticAuthenticator {
+	return &StaticAuthenticator{users: users}
+}
+
+func (s *StaticAuthenticator) Authenticate(user string, password string) (*Identity, error) {
+	if !authenticate(s.getUsers(), &Request{User: user, Password: password}) {
+		return nil, nil
+	}
+	return &Identity{User: user}, nil
+}
+
+func (s *StaticAuthenticator) Refresh(user string, tokenName string) (*Identity, error) {
+	if tokenName != "" {
+		return nil, nil
+	}
+	if err := s.userExists(user); err != nil {
+		return nil, err
+	}
+	return &Identity{User: user}, nil
+}
+
+// SetUsers replaces the users used to authenticate requests
+func (s *StaticAuthenticator) SetUsers(users map[string]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.users = users
+	s.loadErr = nil
+}
+
+// Ready returns the error from the last attempt to reload the users, if it failed
+func (s *StaticAuthenticator) Ready() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.loadErr
+}
+
+// Watch periodically checks the user files for changes and swaps in the new users, if a file can't be loaded the
+// existing users are kept
+func (s *StaticAuthenticator) Watch(files *UserFiles, interval time.Duration) {
+	if len(files.paths()) == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if !files.Changed() {
+				continue
+			}
+			users, err := files.Load()
+			if err != nil {
+				log.Errorf("Unable to reload users, keeping existing users: %s", err)
+				s.lock.Lock()
+				s.loadErr = err
+				s.lock.Unlock()
+				continue
+			}
+			s.SetUsers(users)
+			log.Infof("Reloaded %d users", len(users))
+		}
+	}()
+}
+
+func (s *StaticAuthenticator) getUsers() map[string]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.users
+}
+
+func (s *StaticAuthenticator) userExists(user string) error {
+	if _, ok := s.getUsers()[user]; !ok {
+		return errors.New("unknown user: " + user)
+	}
+	return nil
+}
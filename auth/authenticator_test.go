@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthenticatorChain_Authenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.yml")
+	writeTokens(t, path, testTokens)
+	tokens, err := NewTokenStore(path)
+	if err != nil {
+		t.Fatalf("NewTokenStore() error = %v", err)
+	}
+	chain := AuthenticatorChain{NewStaticAuthenticator(map[string]string{"test": testPasswordHash}), tokens}
+	tests := []struct {
+		name            string
+		user            string
+		password        string
+		wantUser        string
+		wantToken       string
+		wantRefreshable bool
+	}{
+		{name: "Static user", user: "test", password: "test", wantUser: "test", wantRefreshable: true},
+		{name: "Token", user: "ci", password: "test", wantUser: "ci", wantToken: "pipeline", wantRefreshable: true},
+		{name: "Wrong password", user: "test", password: "wrong"},
+		{name: "Unknown user", user: "unknown", password: "test"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := chain.Authenticate(tt.user, tt.password)
+			if err != nil {
+				t.Fatalf("Authenticate() error = %v", err)
+			}
+			if tt.wantUser == "" {
+				if got != nil {
+					t.Errorf("Authenticate() = %v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.User != tt.wantUser || got.refreshable != tt.wantRefreshable {
+				t.Fatalf("Authenticate() = %v, want user %s", got, tt.wantUser)
+			}
+			if (got.Token == nil && tt.wantToken != "") || (got.Token != nil && got.Token.Name != tt.wantToken) {
+				t.Errorf("Authenticate() token = %v, want %s", got.Token, tt.wantToken)
+			}
+		})
+	}
+}
+
+func TestAuthenticatorChain_Refresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.yml")
+	writeTokens(t, path, testTokens)
+	tokens, err := NewTokenStore(path)
+	if err != nil {
+		t.Fatalf("NewTokenStore() error = %v", err)
+	}
+	chain := AuthenticatorChain{
+		NewStaticAuthenticator(map[string]string{"test": testPasswordHash}),
+		NewWebhookAuthenticator("http://localhost", 0),
+		tokens,
+	}
+	tests := []struct {
+		name      string
+		user      string
+		tokenName string
+		wantErr   bool
+	}{
+		{name: "Static user", user: "test"},
+		{name: "Removed user", user: "removed", wantErr: true},
+		{name: "Token", user: "ci", tokenName: "pipeline"},
+		{name: "Token bound to another user", user: "test", tokenName: "pipeline", wantErr: true},
+		{name: "Revoked token", user: "other", tokenName: "revoked", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := chain.Refresh(tt.user, tt.tokenName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Refresh() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.User != tt.user {
+				t.Errorf("Refresh() = %v, want %s", got, tt.user)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"flag"
+
+	"github.com/distribution/distribution/v3/registry/auth/token"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	DenyFile = flag.String("deny", "", "Path to a yaml file of rules in the same format as the ACL whose actions are always denied")
+)
+
+// Authorizer decides which of the requested actions a request is allowed. It is given the scopes approved so far and
+// returns the subset it approves, so it can only ever remove access.
+type Authorizer interface {
+	Authorize(request *Request, scopes []*token.ResourceActions) ([]*token.ResourceActions, error)
+}
+
+// AuthorizerChain passes the scopes through each authorizer in turn, approving only what all of them approve, an empty
+// chain approves nothing
+type AuthorizerChain []Authorizer
+
+// NewAuthorizer returns the built-in policy: authenticated users get everything and anonymous users can pull public
+// repositories, limited by the ACL, expression policy and deny-list when they are set
+func NewAuthorizer(publicPrefixes []string, acl ACL, policy Policy, deny ACL) AuthorizerChain {
+	chain := AuthorizerChain{&DefaultAuthorizer{PublicPrefixes: publicPrefixes}}
+	if acl != nil {
+		chain = append(chain, &ACLAuthorizer{ACL: acl, PublicPrefixes: publicPrefixes})
+	}
+	if policy != nil {
+		chain = append(chain, &PolicyAuthorizer{Policy: policy, PublicPrefixes: publicPrefixes})
+	}
+	if deny != nil {
+		chain = append(chain, &DenyAuthorizer{Rules: deny})
+	}
+	return chain
+}
+
+func (c AuthorizerChain) Authorize(request *Request, scopes []*token.ResourceActions) ([]*token.ResourceActions, error) {
+	if len(c) == 0 {
+		return make([]*token.ResourceActions, 0), nil
+	}
+	var err error
+	for _, authorizer := range c {
+		if len(scopes) == 0 {
+			break
+		}
+		scopes, err = authorizer.Authorize(request, scopes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scopes, nil
+}
+
+// DefaultAuthorizer approves everything for valid credentials and pulls of public repositories for anyone
+type DefaultAuthorizer struct {
+	PublicPrefixes []string
+}
+
+func (d *DefaultAuthorizer) Authorize(request *Request, scopes []*token.ResourceActions) ([]*token.ResourceActions, error) {
+	return filterScopes(scopes, func(scope *token.ResourceActions) *token.ResourceActions {
+		return sanitiseScope(scope, IsScopePublic(d.PublicPrefixes, scope), request.validCredentials)
+	}), nil
+}
+
+// ACLAuthorizer limits authenticated users to the actions the ACL grants them, public repositories can always be
+// pulled
+type ACLAuthorizer struct {
+	ACL            ACL
+	PublicPrefixes []string
+}
+
+func (a *ACLAuthorizer) Authorize(request *Request, scopes []*token.ResourceActions) ([]*token.ResourceActions, error) {
+	if !request.validCredentials {
+		return scopes, nil
+	}
+	return filterScopes(scopes, func(scope *token.ResourceActions) *token.ResourceActions {
+		return a.ACL.restrict(request.User, request.Groups, scope, IsScopePublic(a.PublicPrefixes, scope))
+	}), nil
+}
+
+// DenyAuthorizer removes any actions granted by its rules, a "*" user in a rule also matches anonymous requests and a
+// requested "*" action is removed if any action is denied
+type DenyAuthorizer struct {
+	Rules ACL
+}
+
+func (d *DenyAuthorizer) Authorize(request *Request, scopes []*token.ResourceActions) ([]*token.ResourceActions, error) {
+	return filterScopes(scopes, func(scope *token.ResourceActions) *token.ResourceActions {
+		denied := d.Rules.allowedActions(request.User, request.Groups, scope)
+		actions := make([]string, 0)
+		for _, action := range scope.Actions {
+			if !containsOrWildcard(denied, action) && (action != "*" || len(denied) == 0) {
+				actions = append(actions, action)
+			}
+		}
+		if len(actions) == 0 {
+			log.Debugf("Scope rejected (deny) - User: %s, Type: %s, Name: %s", request.User, scope.Type, scope.Name)
+			return nil
+		}
+		return &token.ResourceActions{
+			Type:    scope.Type,
+			Class:   scope.Class,
+			Name:    scope.Name,
+			Actions: actions,
+		}
+	}), nil
+}
+
+// filterScopes applies the function to each scope, dropping any it returns nil for
+func filterScopes(scopes []*token.ResourceActions, filter func(*token.ResourceActions) *token.ResourceActions) []*token.ResourceActions {
+	filtered := make([]*token.ResourceActions, 0, len(scopes))
+	for _, scope := range scopes {
+		if scope = filter(scope); scope != nil {
+			filtered = append(filtered, scope)
+		}
+	}
+	return filtered
+}
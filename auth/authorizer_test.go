@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/auth/token"
+)
+
+// clientAuthorizer only approves requests from the given client
+type clientAuthorizer string
+
+func (c clientAuthorizer) Authorize(request *Request, scopes []*token.ResourceActions) ([]*token.ResourceActions, error) {
+	if request.ClientID != string(c) {
+		return []*token.ResourceActions{}, nil
+	}
+	return scopes, nil
+}
+
+func TestAuthorizerChain_Authorize(t *testing.T) {
+	deny, err := ParseACL([]byte("- users: [\"*\"]\n  repositories: [\"**\"]\n  actions: [delete]\n- users: [\"*\"]\n  repositories: [\"public/frozen\"]\n  actions: [pull]\n"))
+	if err != nil {
+		t.Fatalf("ParseACL() error = %v", err)
+	}
+	tests := []struct {
+		name               string
+		authorizer         Authorizer
+		request            *Request
+		wantApprovedScopes []*token.ResourceActions
+	}{
+		{
+			name:       "Deny list removes actions",
+			authorizer: NewAuthorizer([]string{"public"}, nil, nil, deny),
+			request: &Request{
+				User:             "test",
+				RequestedScope:   parseScope("repository:app:pull,push,delete"),
+				validCredentials: true,
+			},
+			wantApprovedScopes: parseScope("repository:app:pull,push"),
+		},
+		{
+			name:       "Deny list removes wildcard",
+			authorizer: NewAuthorizer([]string{"public"}, nil, nil, deny),
+			request: &Request{
+				User:             "test",
+				RequestedScope:   parseScope("repository:app:*"),
+				validCredentials: true,
+			},
+			wantApprovedScopes: []*token.ResourceActions{},
+		},
+		{
+			name:       "Deny list applies to anonymous users",
+			authorizer: NewAuthorizer([]string{"public"}, nil, nil, deny),
+			request: &Request{
+				RequestedScope: parseScope("repository:public/frozen:pull repository:public/app:pull"),
+			},
+			wantApprovedScopes: parseScope("repository:public/app:pull"),
+		},
+		{
+			name:       "Custom authorizer intersects",
+			authorizer: append(NewAuthorizer([]string{"public"}, nil, nil, nil), clientAuthorizer("trusted")),
+			request: &Request{
+				User:             "test",
+				ClientID:         "untrusted",
+				RequestedScope:   parseScope("repository:app:pull"),
+				validCredentials: true,
+			},
+			wantApprovedScopes: []*token.ResourceActions{},
+		},
+		{
+			name:       "Empty chain",
+			authorizer: AuthorizerChain{},
+			request: &Request{
+				User:             "test",
+				RequestedScope:   parseScope("repository:app:pull"),
+				validCredentials: true,
+			},
+			wantApprovedScopes: []*token.ResourceActions{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.authorizer.Authorize(tt.request, tt.request.RequestedScope)
+			if err != nil {
+				t.Fatalf("Authorize() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.wantApprovedScopes) {
+				t.Errorf("Authorize() = %v, want %v", actionsToString(got), actionsToString(tt.wantApprovedScopes))
+			}
+		})
+	}
+}
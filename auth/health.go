@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ReadyCheck returns an error if part of the server isn't ready to serve requests
+type ReadyCheck func() error
+
+func (s *Server) addHealthRoutes() {
+	s.Router.Path("/healthz").HandlerFunc(s.HandleHealth).Methods(http.MethodGet, http.MethodHead)
+	s.Router.Path("/readyz").HandlerFunc(s.HandleReady).Methods(http.MethodGet, http.MethodHead)
+}
+
+// HandleHealth reports that the server is running
+func (s *Server) HandleHealth(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain")
+	_, _ = writer.Write([]byte("ok\n"))
+}
+
+// HandleReady runs the signing key check and any other ready checks, responding with a 503 listing the failures if
+// any fail
+func (s *Server) HandleReady(writer http.ResponseWriter, _ *http.Request) {
+	checks := map[string]ReadyCheck{"signing-key": s.checkSigningKeys}
+	maps.Copy(checks, s.ReadyChecks)
+	var failures []string
+	for _, name := range slices.Sorted(maps.Keys(checks)) {
+		if err := checks[name](); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+	writer.Header().Set("Content-Type", "text/plain")
+	writer.Header().Set("Cache-Control", "no-store")
+	if len(failures) > 0 {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = writer.Write([]byte(strings.Join(failures, "\n") + "\n"))
+		return
+	}
+	_, _ = writer.Write([]byte("ok\n"))
+}
+
+// checkSigningKeys checks the top level signing key, and those of any services with their own, have been loaded
+func (s *Server) checkSigningKeys() error {
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+	if s.privateKey == nil {
+		return errors.New("signing key not loaded")
+	}
+	for _, registry := range s.Registries {
+		if registry.CertPath != "" && registry.privateKey == nil {
+			return fmt.Errorf("signing key for %s not loaded", registry.Service)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestServer_HandleReady(t *testing.T) {
+	tests := []struct {
+		name       string
+		noKey      bool
+		checks     map[string]ReadyCheck
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "Ready", wantStatus: http.StatusOK, wantBody: "ok"},
+		{name: "Passing check", checks: map[string]ReadyCheck{"users": func() error { return nil }}, wantStatus: http.StatusOK, wantBody: "ok"},
+		{name: "Failing check", checks: map[string]ReadyCheck{"users": func() error { return errors.New("broken") }}, wantStatus: http.StatusServiceUnavailable, wantBody: "users: broken"},
+		{name: "No signing key", noKey: true, wantStatus: http.StatusServiceUnavailable, wantBody: "signing-key: signing key not loaded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t)
+			server.Router = mux.NewRouter()
+			server.ReadyChecks = tt.checks
+			if tt.noKey {
+				server.privateKey = nil
+			}
+			server.addHealthRoutes()
+			recorder := httptest.NewRecorder()
+			server.Router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if recorder.Code != tt.wantStatus || strings.TrimSpace(recorder.Body.String()) != tt.wantBody {
+				t.Errorf("readyz = %d %q, want %d %q", recorder.Code, recorder.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			recorder = httptest.NewRecorder()
+			server.Router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if recorder.Code != http.StatusOK {
+				t.Errorf("healthz = %d, want %d", recorder.Code, http.StatusOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// HandleJWKS publishes the public keys tokens are signed with as a JSON web key set, using the same key IDs as the
+// kid header of issued tokens
+func (s *Server) HandleJWKS(writer http.ResponseWriter, _ *http.Request) {
+	keys := s.publicKeys()
+	keySet := jose.JSONWebKeySet{Keys: make([]jose.JSONWebKey, 0, len(keys))}
+	for _, keyID := range slices.Sorted(maps.Keys(keys)) {
+		keySet.Keys = append(keySet.Keys, jose.JSONWebKey{
+			Key:       keys[keyID].CryptoPublicKey(),
+			KeyID:     keyID,
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		})
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "max-age=300")
+	_ = json.NewEncoder(writer).Encode(keySet)
+}
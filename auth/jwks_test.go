@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/libtrust"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+func TestServer_HandleJWKS(t *testing.T) {
+	server := newTestServer(t)
+	stagingKey, err := libtrust.GenerateRSA2048PrivateKey()
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	server.Registries = map[string]*Registry{
+		"staging": {Service: "staging", Issuer: "issuer", Authorizer: server.Authorizer, publicKey: stagingKey.PublicKey(), privateKey: stagingKey},
+		"other":   {Service: "other", Issuer: "issuer", Authorizer: server.Authorizer},
+	}
+	recorder := httptest.NewRecorder()
+	server.HandleJWKS(recorder, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	keySet := &jose.JSONWebKeySet{}
+	if err = json.Unmarshal(recorder.Body.Bytes(), keySet); err != nil {
+		t.Fatalf("unable to parse key set: %v", err)
+	}
+	if len(keySet.Keys) != 2 {
+		t.Fatalf("HandleJWKS() = %d keys, want 2", len(keySet.Keys))
+	}
+	for _, service := range []string{"service", "staging", "other"} {
+		accessToken, err := server.GetServiceAccessToken(service, "app")
+		if err != nil {
+			t.Fatalf("GetServiceAccessToken() error = %v", err)
+		}
+		parsed, err := jwt.ParseSigned(accessToken, []jose.SignatureAlgorithm{jose.RS256})
+		if err != nil {
+			t.Fatalf("unable to parse token: %v", err)
+		}
+		keys := keySet.Key(parsed.Headers[0].KeyID)
+		if len(keys) != 1 || keys[0].Algorithm != string(jose.RS256) || keys[0].Use != "sig" {
+			t.Fatalf("HandleJWKS() keys for %s = %v", parsed.Headers[0].KeyID, keys)
+		}
+		claims := &ClaimSetBodge{}
+		if err = parsed.Claims(keys[0].Key, claims); err != nil || claims.Audience != service {
+			t.Errorf("token for %s not verified with published key: %v", service, err)
+		}
+	}
+}
@@ -1,16 +1,20 @@
 package auth
 
 import (
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
-	"math/rand"
+	"os"
 	"time"
 
 	"github.com/distribution/distribution/v3/registry/auth/token"
 	"github.com/docker/libtrust"
 	"github.com/go-jose/go-jose/v4"
 	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/greboid/registryauth/certs"
+	"github.com/greboid/registryauth/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -27,26 +31,30 @@ type ClaimSetBodge struct {
 	Access     []*token.ResourceActions `json:"access"`
 }
 
-func CreateToken(publicKey libtrust.PublicKey, privateKey libtrust.PrivateKey, issuer string, request *Request) (string, error) {
-	now := time.Now()
-
+func CreateToken(publicKey libtrust.PublicKey, privateKey libtrust.PrivateKey, issuer string, lifetime TokenLifetime, now time.Time, request *Request) (string, error) {
 	claims := ClaimSetBodge{
 		Issuer:     issuer,
 		Subject:    request.User,
 		Audience:   request.Service,
-		NotBefore:  now.Add(-1 * time.Minute).Unix(),
+		NotBefore:  now.Add(-lifetime.Skew).Unix(),
 		IssuedAt:   now.Unix(),
-		Expiration: now.Add(2 * time.Minute).Unix(),
-		JWTID:      fmt.Sprintf("%d", rand.Int63()),
+		Expiration: now.Add(lifetime.Expiry).Unix(),
+		JWTID:      newJWTID(now),
 		Access:     request.ApprovedScope,
 	}
+	request.jti = claims.JWTID
 
-	log.Debugf("Creating token for user: %s, audience: %s, approved scopes: %d", request.User, request.Service, len(request.ApprovedScope))
+	log.Debugf("Creating token %s for user: %s, audience: %s, expiry: %s, approved scopes: %d", claims.JWTID, request.User, request.Service, lifetime.Expiry, len(request.ApprovedScope))
 	for i, scope := range request.ApprovedScope {
 		log.Debugf("  Scope %d - Type: %s, Name: %s, Class: %s, Actions: %v",
 			i+1, scope.Type, scope.Name, scope.Class, scope.Actions)
 	}
 
+	return signClaims(publicKey, privateKey, claims)
+}
+
+func signClaims(publicKey libtrust.PublicKey, privateKey libtrust.PrivateKey, claims any) (string, error) {
+	defer metrics.ObserveSince(metrics.SigningDuration, time.Now())
 	// Create a signer using the private key
 	signerOpts := &jose.SignerOptions{}
 	signerOpts = signerOpts.WithType("JWT")
@@ -75,24 +83,124 @@ func CreateToken(publicKey libtrust.PublicKey, privateKey libtrust.PrivateKey, i
 	return tokenString, nil
 }
 
-func (s *Server) LoadCertAndKey(certFile string, keyFile string) error {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+var (
+	errTokenService = errors.New("token not issued for service")
+)
+
+// verifySigned checks a token was signed by this server, with the key named in its header, and unmarshalls its claims
+func (s *Server) verifySigned(tokenString string, claims any) error {
+	if tokenString == "" {
+		return errors.New("no token")
+	}
+	parsed, err := jwt.ParseSigned(tokenString, []jose.SignatureAlgorithm{jose.RS256})
 	if err != nil {
 		return err
 	}
-	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	key, ok := s.publicKeys()[parsed.Headers[0].KeyID]
+	if !ok {
+		return fmt.Errorf("unknown signing key: %s", parsed.Headers[0].KeyID)
+	}
+	return parsed.Claims(key.CryptoPublicKey(), claims)
+}
+
+// verifyToken checks an access token was issued by this server, is currently valid and has not been revoked
+func (s *Server) verifyToken(tokenString string) (*ClaimSetBodge, error) {
+	claims := &ClaimSetBodge{}
+	err := s.verifySigned(tokenString, claims)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	pk, err := libtrust.FromCryptoPublicKey(x509Cert.PublicKey)
+	if claims.Audience == refreshTokenAudience {
+		return nil, errors.New("refresh tokens are not access tokens")
+	}
+	if registry := s.registry(claims.Audience); registry == nil || claims.Issuer != registry.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %s for service %s", claims.Issuer, claims.Audience)
+	}
+	now := time.Now().Unix()
+	if now > claims.Expiration || now < claims.NotBefore {
+		return nil, errors.New("token not currently valid")
+	}
+	if s.Revocations.IsRevoked(claims.JWTID, claims.Subject, time.Unix(claims.IssuedAt, 0)) {
+		return nil, errors.New("token revoked")
+	}
+	return claims, nil
+}
+
+// newJWTID generates a UUIDv7 from the issue time and a CSPRNG, so IDs are unique, unpredictable and sort by time
+func newJWTID(issuedAt time.Time) string {
+	id := make([]byte, 16)
+	_, err := rand.Read(id[6:])
 	if err != nil {
-		return err
+		// crypto/rand never returns an error on supported platforms
+		panic(fmt.Sprintf("unable to generate jwt id: %s", err))
 	}
-	prk, err := libtrust.FromCryptoPrivateKey(cert.PrivateKey)
+	millis := uint64(issuedAt.UnixMilli())
+	id[0] = byte(millis >> 40)
+	id[1] = byte(millis >> 32)
+	id[2] = byte(millis >> 24)
+	id[3] = byte(millis >> 16)
+	id[4] = byte(millis >> 8)
+	id[5] = byte(millis)
+	id[6] = (id[6] & 0x0f) | 0x70
+	id[8] = (id[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+func (s *Server) LoadCertAndKey(certFile string, keyFile string) error {
+	pk, prk, bundle, err := loadSigningKeys(s.Service, certFile, keyFile)
 	if err != nil {
 		return err
 	}
+	s.keyLock.Lock()
+	defer s.keyLock.Unlock()
 	s.publicKey = pk
 	s.privateKey = prk
+	s.bundleKeys = bundle
 	return nil
 }
+
+// loadSigningKeys loads the key pair tokens are signed with, and the public keys of the certificate bundle beside it
+// if there is one
+func loadSigningKeys(service string, certFile string, keyFile string) (libtrust.PublicKey, libtrust.PrivateKey, []libtrust.PublicKey, error) {
+	pk, prk, expiry, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	metrics.CertificateExpiry.WithLabelValues(service).Set(float64(expiry.Unix()))
+	certificates, err := certs.ReadBundle(certs.BundlePath(certFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return pk, prk, nil, nil
+	} else if err != nil {
+		return nil, nil, nil, err
+	}
+	var bundle []libtrust.PublicKey
+	for _, certificate := range certificates {
+		key, err := libtrust.FromCryptoPublicKey(certificate.PublicKey)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		bundle = append(bundle, key)
+	}
+	return pk, prk, bundle, nil
+}
+
+// loadKeyPair loads a certificate and its private key, returning the keys and when the certificate expires
+func loadKeyPair(certFile string, keyFile string) (libtrust.PublicKey, libtrust.PrivateKey, time.Time, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	pk, err := libtrust.FromCryptoPublicKey(x509Cert.PublicKey)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	prk, err := libtrust.FromCryptoPrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	return pk, prk, x509Cert.NotAfter, nil
+}
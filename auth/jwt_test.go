@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_newJWTID(t *testing.T) {
+	format := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	issuedAt := time.UnixMilli(1700000000123)
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id := newJWTID(issuedAt)
+		if !format.MatchString(id) {
+			t.Fatalf("newJWTID() = %s, not a UUIDv7", id)
+		}
+		if seen[id] {
+			t.Fatalf("newJWTID() = %s, duplicate id", id)
+		}
+		seen[id] = true
+		decoded, err := jwtIDTime(id)
+		if err != nil {
+			t.Fatalf("jwtIDTime() error = %v", err)
+		}
+		if !decoded.Equal(issuedAt) {
+			t.Fatalf("jwtIDTime() = %s, want %s", decoded, issuedAt)
+		}
+	}
+	if newJWTID(issuedAt) >= newJWTID(issuedAt.Add(time.Millisecond)) {
+		t.Errorf("newJWTID() ids do not sort by issue time")
+	}
+}
+
+// jwtIDTime returns the issue time encoded in a JWT ID generated by newJWTID
+func jwtIDTime(jti string) (time.Time, error) {
+	id, err := hex.DecodeString(strings.ReplaceAll(jti, "-", ""))
+	if err != nil || len(id) != 16 || id[6]>>4 != 7 {
+		return time.Time{}, fmt.Errorf("invalid jwt id: %s", jti)
+	}
+	millis := int64(id[0])<<40 | int64(id[1])<<32 | int64(id[2])<<24 | int64(id[3])<<16 | int64(id[4])<<8 | int64(id[5])
+	return time.UnixMilli(millis), nil
+}
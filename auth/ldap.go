@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	LDAPURL            = flag.String("ldap-url", "", "URL of an LDAP server to authenticate users against, eg ldaps://ldap.example.com")
+	LDAPBindDN         = flag.String("ldap-bind-dn", "", "DN to bind as when searching for users, binds anonymously if not set")
+	LDAPBindPassword   = flag.String("ldap-bind-password", "", "Password for the LDAP bind DN")
+	LDAPBaseDN         = flag.String("ldap-base-dn", "", "Base DN to search for users under")
+	LDAPUserFilter     = flag.String("ldap-user-filter", "(uid=%s)", "LDAP filter to find a user, %s is replaced with the username")
+	LDAPUserAttribute  = flag.String("ldap-user-attribute", "uid", "Attribute of an LDAP user holding their canonical username, which is used rather than the username entered")
+	LDAPGroupAttribute = flag.String("ldap-group-attribute", "memberOf", "Attribute of an LDAP user listing the DNs of their groups")
+	LDAPGroupInput     = flag.String("ldap-groups", "", "Yaml formatted map of LDAP group DNs to registry groups, if not set the group's CN is used")
+)
+
+type ldapConn interface {
+	Bind(username string, password string) error
+	Search(request *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAPAuthenticator verifies users by searching for them with the user filter and binding as the user found, the
+// user's LDAP groups are mapped to registry groups. Users are identified by the user attribute of the entry found, as
+// directories usually match the filter case insensitively.
+type LDAPAuthenticator struct {
+	URL            string
+	BindDN         string
+	BindPassword   string
+	BaseDN         string
+	UserFilter     string
+	UserAttribute  string
+	GroupAttribute string
+	GroupMap       map[string][]string
+	dial           func() (ldapConn, error)
+}
+
+func NewLDAPAuthenticator(url string, bindDN string, bindPassword string, baseDN string, userFilter string, userAttribute string, groupAttribute string, groupInput string) (*LDAPAuthenticator, error) {
+	if url == "" {
+		return nil, nil
+	}
+	if !strings.Contains(userFilter, "%s") {
+		return nil, fmt.Errorf("ldap user filter must contain %%s: %s", userFilter)
+	}
+	groupMap := map[string][]string{}
+	err := yaml.Unmarshal([]byte(groupInput), groupMap)
+	if err != nil {
+		return nil, err
+	}
+	normalisedMap := map[string][]string{}
+	for dn, groups := range groupMap {
+		normalisedMap[strings.ToLower(dn)] = groups
+	}
+	authenticator := &LDAPAuthenticator{
+		URL:            url,
+		BindDN:         bindDN,
+		BindPassword:   bindPassword,
+		BaseDN:         baseDN,
+		UserFilter:     userFilter,
+		UserAttribute:  userAttribute,
+		GroupAttribute: groupAttribute,
+		GroupMap:       normalisedMap,
+	}
+	authenticator.dial = func() (ldapConn, error) {
+		return ldap.DialURL(authenticator.URL)
+	}
+	return authenticator, nil
+}
+
+// Authenticate binds as the user to check their password, returning their registry groups
+func (l *LDAPAuthenticator) Authenticate(user string, password string) (*Identity, error) {
+	if user == "" || password == "" {
+		// An empty password would be an unauthenticated bind, which most servers accept
+		return nil, errors.New("username and password required")
+	}
+	conn, entry, err := l.find(user)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	err = conn.Bind(entry.DN, password)
+	if err != nil {
+		return nil, fmt.Errorf("ldap bind failed for %s: %w", user, err)
+	}
+	return l.identity(entry)
+}
+
+// Refresh checks a user authenticated by a refresh token is still in the directory
+func (l *LDAPAuthenticator) Refresh(user string, tokenName string) (*Identity, error) {
+	if tokenName != "" {
+		return nil, nil
+	}
+	conn, entry, err := l.find(user)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.Close()
+	return l.identity(entry)
+}
+
+// identity returns the entry's canonical username and registry groups
+func (l *LDAPAuthenticator) identity(entry *ldap.Entry) (*Identity, error) {
+	user := entry.GetAttributeValue(l.UserAttribute)
+	if user == "" {
+		return nil, fmt.Errorf("ldap entry %s has no %s", entry.DN, l.UserAttribute)
+	}
+	return &Identity{User: user, Groups: l.groups(entry)}, nil
+}
+
+func (l *LDAPAuthenticator) find(user string) (ldapConn, *ldap.Entry, error) {
+	conn, err := l.dial()
+	if err != nil {
+		return nil, nil, fmt.Errorf("ldap connection failed: %w", err)
+	}
+	if l.BindDN != "" {
+		err = conn.Bind(l.BindDN, l.BindPassword)
+		if err != nil {
+			_ = conn.Close()
+			return nil, nil, fmt.Errorf("ldap service bind failed: %w", err)
+		}
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		l.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(l.UserFilter, ldap.EscapeFilter(user)),
+		[]string{"dn", l.UserAttribute, l.GroupAttribute},
+		nil,
+	))
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("ldap search failed: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("ldap search for %s returned %d entries", user, len(result.Entries))
+	}
+	return conn, result.Entries[0], nil
+}
+
+func (l *LDAPAuthenticator) groups(entry *ldap.Entry) []string {
+	var groups []string
+	for _, groupDN := range entry.GetAttributeValues(l.GroupAttribute) {
+		if mapped, ok := l.GroupMap[strings.ToLower(groupDN)]; ok {
+			groups = append(groups, mapped...)
+			continue
+		}
+		if len(l.GroupMap) > 0 {
+			continue
+		}
+		parsed, err := ldap.ParseDN(groupDN)
+		if err != nil || len(parsed.RDNs) == 0 {
+			log.Debugf("Ignoring unparseable ldap group: %s", groupDN)
+			continue
+		}
+		for _, attribute := range parsed.RDNs[0].Attributes {
+			if strings.EqualFold(attribute.Type, "cn") {
+				groups = append(groups, attribute.Value)
+			}
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeLDAP is an in-process stand in for an LDAP directory, holding entries by DN with their passwords
+type fakeLDAP struct {
+	passwords map[string]string
+	entries   []*ldap.Entry
+	bound     string
+}
+
+func (f *fakeLDAP) Bind(username string, password string) error {
+	if expected, ok := f.passwords[username]; !ok || expected != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	f.bound = username
+	return nil
+}
+
+func (f *fakeLDAP) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if f.bound == "" {
+		return nil, ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("not bound"))
+	}
+	// Like most directories uid matches case insensitively, and an unescaped * matches any value
+	value, ok := strings.CutPrefix(strings.TrimSuffix(request.Filter, ")"), "(uid=")
+	if !ok {
+		return nil, ldap.NewError(ldap.LDAPResultFilterError, errors.New("unsupported filter"))
+	}
+	result := &ldap.SearchResult{}
+	for _, entry := range f.entries {
+		uid := entry.GetAttributeValue("uid")
+		if (value == "*" || strings.EqualFold(value, ldap.EscapeFilter(uid))) && strings.HasSuffix(entry.DN, request.BaseDN) {
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeLDAP) Close() error {
+	return nil
+}
+
+func newFakeLDAPAuthenticator(t *testing.T, groupInput string) *LDAPAuthenticator {
+	authenticator, err := NewLDAPAuthenticator("ldap://localhost", "cn=service,dc=example,dc=com", "service",
+		"ou=people,dc=example,dc=com", "(uid=%s)", "uid", "memberOf", groupInput)
+	if err != nil {
+		t.Fatalf("NewLDAPAuthenticator() error = %v", err)
+	}
+	authenticator.dial = func() (ldapConn, error) {
+		return &fakeLDAP{
+			passwords: map[string]string{
+				"cn=service,dc=example,dc=com":          "service",
+				"uid=alice,ou=people,dc=example,dc=com": "alice-password",
+			},
+			entries: []*ldap.Entry{
+				ldap.NewEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+					"uid":      {"alice"},
+					"memberOf": {"cn=Release,ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com"},
+				}),
+			},
+		}, nil
+	}
+	return authenticator
+}
+
+func TestLDAPAuthenticator_Authenticate(t *testing.T) {
+	tests := []struct {
+		name       string
+		groupInput string
+		user       string
+		password   string
+		wantUser   string
+		wantGroups []string
+		wantErr    bool
+	}{
+		{name: "Valid password", user: "alice", password: "alice-password", wantUser: "alice", wantGroups: []string{"Release", "staff"}},
+		{name: "Canonical username", user: "ALICE", password: "alice-password", wantUser: "alice", wantGroups: []string{"Release", "staff"}},
+		{name: "Mapped groups", groupInput: "CN=release,OU=groups,DC=example,DC=com: [release, developers]", user: "alice", password: "alice-password", wantUser: "alice", wantGroups: []string{"developers", "release"}},
+		{name: "Wrong password", user: "alice", password: "wrong", wantErr: true},
+		{name: "Empty password", user: "alice", password: "", wantErr: true},
+		{name: "Unknown user", user: "bob", password: "alice-password", wantErr: true},
+		{name: "Filter injection", user: "*", password: "alice-password", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := newFakeLDAPAuthenticator(t, tt.groupInput)
+			got, err := authenticator.Authenticate(tt.user, tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (got.User != tt.wantUser || !reflect.DeepEqual(got.Groups, tt.wantGroups)) {
+				t.Errorf("Authenticate() = %s %v, want %s %v", got.User, got.Groups, tt.wantUser, tt.wantGroups)
+			}
+		})
+	}
+}
+
+func TestServer_AuthorizeLDAP(t *testing.T) {
+	acl, err := ParseACL([]byte("- groups: [Release]\n  repositories: [\"prod/**\"]\n  actions: [pull, push]\n"))
+	if err != nil {
+		t.Fatalf("ParseACL() error = %v", err)
+	}
+	server := newTestServer(t)
+	server.Authorizer = NewAuthorizer(server.PublicPrefixes, acl, nil, nil)
+	server.Authenticators = append(server.Authenticators, newFakeLDAPAuthenticator(t, ""))
+	authRequest := &Request{
+		User:           "Alice",
+		Password:       "alice-password",
+		RequestedScope: parseScope("repository:prod/app:pull,push"),
+	}
+	server.authenticateRequest(authRequest, server.defaultRegistry())
+	if !authRequest.validCredentials || authRequest.User != "alice" {
+		t.Fatalf("authenticateRequest() did not authenticate ldap user as alice: %s", authRequest.User)
+	}
+	err = authRequest.getApprovedScope(server.Authorizer, server.PublicPrefixes)
+	if err != nil {
+		t.Fatalf("getApprovedScope() error = %v", err)
+	}
+	if got := formatScope(authRequest.ApprovedScope); got != "repository:prod/app:pull,push" {
+		t.Errorf("getApprovedScope() = %s", got)
+	}
+	identity, err := server.Authenticators.Refresh("alice", "")
+	if err != nil || !reflect.DeepEqual(identity.Groups, []string{"Release", "staff"}) {
+		t.Errorf("Refresh() = %v, %v", identity, err)
+	}
+}
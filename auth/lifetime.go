@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth/token"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	TokenExpiry    = flag.Duration("token-expiry", 2*time.Minute, "How long issued tokens are valid for")
+	TokenSkew      = flag.Duration("token-skew", time.Minute, "How far the not before time of issued tokens is backdated to allow for clock skew")
+	TokenOverrides = flag.String("token-overrides", "", "Yaml formatted list of token lifetimes for specific users, groups or actions")
+)
+
+// TokenLifetime controls the validity window of an issued token
+type TokenLifetime struct {
+	Expiry time.Duration
+	Skew   time.Duration
+}
+
+// TokenLifetimes holds the default lifetime and any overrides, the first matching override is used
+type TokenLifetimes struct {
+	Default   TokenLifetime
+	Overrides []*LifetimeOverride
+}
+
+// LifetimeOverride applies to requests from any of the users or groups that have been approved any of the actions,
+// empty lists match everything and an empty expiry or skew keeps the default
+type LifetimeOverride struct {
+	Users    []string `yaml:"users"`
+	Groups   []string `yaml:"groups"`
+	Actions  []string `yaml:"actions"`
+	Expiry   string   `yaml:"expiry"`
+	Skew     string   `yaml:"skew"`
+	lifetime TokenLifetime
+}
+
+func ParseTokenLifetimes(expiry time.Duration, skew time.Duration, overrideInput string) (*TokenLifetimes, error) {
+	var overrides []*LifetimeOverride
+	err := yaml.UnmarshalStrict([]byte(overrideInput), &overrides)
+	if err != nil {
+		return nil, err
+	}
+	return NewTokenLifetimes(expiry, skew, overrides)
+}
+
+func NewTokenLifetimes(expiry time.Duration, skew time.Duration, overrides []*LifetimeOverride) (*TokenLifetimes, error) {
+	if expiry <= 0 {
+		return nil, fmt.Errorf("token expiry must be positive")
+	}
+	if skew < 0 {
+		return nil, fmt.Errorf("token skew must not be negative")
+	}
+	lifetimes := &TokenLifetimes{
+		Default:   TokenLifetime{Expiry: expiry, Skew: skew},
+		Overrides: overrides,
+	}
+	var err error
+	for index, override := range lifetimes.Overrides {
+		override.lifetime = lifetimes.Default
+		if override.Expiry != "" {
+			override.lifetime.Expiry, err = time.ParseDuration(override.Expiry)
+			if err != nil || override.lifetime.Expiry <= 0 {
+				return nil, fmt.Errorf("token override %d: invalid expiry: %s", index+1, override.Expiry)
+			}
+		}
+		if override.Skew != "" {
+			override.lifetime.Skew, err = time.ParseDuration(override.Skew)
+			if err != nil || override.lifetime.Skew < 0 {
+				return nil, fmt.Errorf("token override %d: invalid skew: %s", index+1, override.Skew)
+			}
+		}
+	}
+	return lifetimes, nil
+}
+
+func (t *TokenLifetimes) forRequest(request *Request) TokenLifetime {
+	if t == nil {
+		return TokenLifetime{Expiry: 2 * time.Minute, Skew: time.Minute}
+	}
+	for _, override := range t.Overrides {
+		if override.matches(request) {
+			return override.lifetime
+		}
+	}
+	return t.Default
+}
+
+func (o *LifetimeOverride) matches(request *Request) bool {
+	if len(o.Users) > 0 || len(o.Groups) > 0 {
+		if !request.validCredentials {
+			return false
+		}
+		if !containsOrWildcard(o.Users, request.User) && !matchesAnyGroup(o.Groups, request.Groups) {
+			return false
+		}
+	}
+	if len(o.Actions) > 0 && !hasAnyAction(request.ApprovedScope, o.Actions) {
+		return false
+	}
+	return true
+}
+
+func matchesAnyGroup(allowed []string, groups []string) bool {
+	for _, group := range groups {
+		if containsOrWildcard(allowed, group) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyAction(scopes []*token.ResourceActions, actions []string) bool {
+	for _, scope := range scopes {
+		if len(intersectActions(scope.Actions, actions)) > 0 {
+			return true
+		}
+	}
+	return false
+}
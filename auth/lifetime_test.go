@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth/token"
+	"github.com/docker/libtrust"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const testOverrides = `
+- users: [ci]
+  actions: [push]
+  expiry: 30m
+- groups: [release]
+  expiry: 10m
+  skew: 5m
+- actions: [push]
+  expiry: 5m
+`
+
+func TestTokenLifetimes_forRequest(t *testing.T) {
+	lifetimes, err := ParseTokenLifetimes(2*time.Minute, time.Minute, testOverrides)
+	if err != nil {
+		t.Fatalf("ParseTokenLifetimes() error = %v", err)
+	}
+	push := []*token.ResourceActions{{Type: "repository", Name: "test", Actions: []string{"pull", "push"}}}
+	pull := []*token.ResourceActions{{Type: "repository", Name: "test", Actions: []string{"pull"}}}
+	tests := []struct {
+		name    string
+		request *Request
+		want    TokenLifetime
+	}{
+		{
+			name:    "Default",
+			request: &Request{User: "someone", ApprovedScope: pull},
+			want:    TokenLifetime{Expiry: 2 * time.Minute, Skew: time.Minute},
+		},
+		{
+			name:    "User and action",
+			request: &Request{User: "ci", validCredentials: true, ApprovedScope: push},
+			want:    TokenLifetime{Expiry: 30 * time.Minute, Skew: time.Minute},
+		},
+		{
+			name:    "User without action",
+			request: &Request{User: "ci", validCredentials: true, ApprovedScope: pull},
+			want:    TokenLifetime{Expiry: 2 * time.Minute, Skew: time.Minute},
+		},
+		{
+			name:    "Group",
+			request: &Request{User: "someone", Groups: []string{"release"}, validCredentials: true, ApprovedScope: pull},
+			want:    TokenLifetime{Expiry: 10 * time.Minute, Skew: 5 * time.Minute},
+		},
+		{
+			name:    "Action only",
+			request: &Request{User: "someone", ApprovedScope: push},
+			want:    TokenLifetime{Expiry: 5 * time.Minute, Skew: time.Minute},
+		},
+		{
+			name:    "User without valid credentials",
+			request: &Request{User: "ci", ApprovedScope: push},
+			want:    TokenLifetime{Expiry: 5 * time.Minute, Skew: time.Minute},
+		},
+		{
+			name:    "Group without valid credentials",
+			request: &Request{User: "someone", Groups: []string{"release"}, ApprovedScope: pull},
+			want:    TokenLifetime{Expiry: 2 * time.Minute, Skew: time.Minute},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lifetimes.forRequest(tt.request); got != tt.want {
+				t.Errorf("forRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTokenLifetimes_Invalid(t *testing.T) {
+	if _, err := ParseTokenLifetimes(0, time.Minute, ""); err == nil {
+		t.Errorf("ParseTokenLifetimes() expected error for zero expiry")
+	}
+	if _, err := ParseTokenLifetimes(time.Minute, time.Minute, "- expiry: soon\n"); err == nil {
+		t.Errorf("ParseTokenLifetimes() expected error for invalid expiry")
+	}
+}
+
+func TestCreateToken_Lifetime(t *testing.T) {
+	privateKey, err := libtrust.GenerateRSA2048PrivateKey()
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	lifetime := TokenLifetime{Expiry: 15 * time.Minute, Skew: 30 * time.Second}
+	signed, err := CreateToken(privateKey.PublicKey(), privateKey, "issuer", lifetime, now, &Request{User: "test", Service: "service"})
+	if err != nil {
+		t.Fatalf("CreateToken() error = %v", err)
+	}
+	parsed, err := jwt.ParseSigned(signed, []jose.SignatureAlgorithm{jose.RS256})
+	if err != nil {
+		t.Fatalf("unable to parse token: %v", err)
+	}
+	claims := ClaimSetBodge{}
+	err = parsed.Claims(privateKey.PublicKey().CryptoPublicKey(), &claims)
+	if err != nil {
+		t.Fatalf("unable to verify token: %v", err)
+	}
+	if claims.IssuedAt != now.Unix() {
+		t.Errorf("IssuedAt = %d, want %d", claims.IssuedAt, now.Unix())
+	}
+	if claims.Expiration != now.Add(15*time.Minute).Unix() {
+		t.Errorf("Expiration = %d, want %d", claims.Expiration, now.Add(15*time.Minute).Unix())
+	}
+	if claims.NotBefore != now.Add(-30*time.Second).Unix() {
+		t.Errorf("NotBefore = %d, want %d", claims.NotBefore, now.Add(-30*time.Second).Unix())
+	}
+}
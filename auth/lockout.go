@@ -0,0 +1,250 @@
+package auth
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	LockoutThreshold = flag.Int("lockout-threshold", 5, "Number of failed logins for a user or IP before further attempts are delayed, 0 disables lockouts")
+	LockoutBackoff   = flag.Duration("lockout-backoff", time.Second, "How long attempts are delayed once the lockout threshold is reached, doubling with each further failure")
+	LockoutMax       = flag.Duration("lockout-max", 15*time.Minute, "The longest a user or IP can be locked out for")
+	LockoutReset     = flag.Duration("lockout-reset", time.Hour, "How long after the last failed login a user or IP's failures are forgotten")
+	TrustedProxies   = flag.String("trusted-proxies", "", "Comma separated IPs or CIDRs of proxies whose X-Forwarded-For header is trusted for the client IP")
+)
+
+// lockoutLimit caps the users and IPs with failures tracked, so guessing at many made up usernames can't exhaust
+// memory
+const lockoutLimit = 10000
+
+// LockoutTracker counts failed logins per user and per client IP. Once the threshold is reached each further attempt
+// must wait for the backoff, which doubles with each failure up to the maximum, failures are forgotten once the reset
+// duration has passed without another. Attempts in progress count towards the threshold, so concurrent guesses can't
+// exceed it. A nil tracker never locks anything out.
+type LockoutTracker struct {
+	Threshold int
+	Backoff   time.Duration
+	Max       time.Duration
+	Reset     time.Duration
+	lock      sync.Mutex
+	failures  map[string]*loginFailures
+}
+
+type loginFailures struct {
+	count   int
+	pending int
+	last    time.Time
+}
+
+// LockedError is returned when a user or IP is locked out, the request can be retried after RetryAfter
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("too many failed logins, retry after %s", e.RetryAfter.Round(time.Second))
+}
+
+func NewLockoutTracker(threshold int, backoff time.Duration, maxBackoff time.Duration, reset time.Duration) *LockoutTracker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &LockoutTracker{
+		Threshold: threshold,
+		Backoff:   backoff,
+		Max:       maxBackoff,
+		Reset:     max(reset, maxBackoff),
+		failures:  map[string]*loginFailures{},
+	}
+}
+
+// Attempt returns an error if either the user or the IP is locked out, otherwise it reserves an attempt for both that
+// must be finished by calling Failed or Succeeded. Only as many attempts as there are failures left before the
+// threshold can be in progress at once, or a single attempt once the threshold has been reached.
+func (l *LockoutTracker) Attempt(user string, ip string) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	keys := []string{userLockoutKey(user), ipLockoutKey(ip)}
+	retry := max(l.retryAfter(keys[0], now), l.retryAfter(keys[1], now))
+	if retry > 0 {
+		return &LockedError{RetryAfter: retry}
+	}
+	for _, key := range keys {
+		failures, ok := l.failures[key]
+		if ok && failures.pending >= max(l.Threshold-failures.count, 1) {
+			return &LockedError{RetryAfter: l.Backoff}
+		}
+	}
+	for _, key := range keys {
+		l.tracked(key, now).pending++
+	}
+	return nil
+}
+
+// Failed finishes an attempt, recording a failed login for the user and the IP
+func (l *LockoutTracker) Failed(user string, ip string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	for _, key := range []string{userLockoutKey(user), ipLockoutKey(ip)} {
+		failures := l.tracked(key, now)
+		failures.pending = max(failures.pending-1, 0)
+		failures.count++
+		failures.last = now
+		if failures.count == l.Threshold {
+			log.Warnf("Lockout threshold reached for %s", key)
+		}
+	}
+}
+
+// Succeeded finishes an attempt, forgetting the user's failures. The IP's are kept so that one valid account can't be
+// used to reset them.
+func (l *LockoutTracker) Succeeded(user string, ip string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.failures, userLockoutKey(user))
+	if failures, ok := l.failures[ipLockoutKey(ip)]; ok {
+		failures.pending = max(failures.pending-1, 0)
+		if failures.pending == 0 && failures.count == 0 {
+			delete(l.failures, ipLockoutKey(ip))
+		}
+	}
+}
+
+// Clear forgets the failures of the user and/or IP
+func (l *LockoutTracker) Clear(user string, ip string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if user != "" {
+		delete(l.failures, userLockoutKey(user))
+		log.Infof("Cleared lockout for user: %s", user)
+	}
+	if ip != "" {
+		delete(l.failures, ipLockoutKey(ip))
+		log.Infof("Cleared lockout for ip: %s", ip)
+	}
+}
+
+// tracked returns the failures for the key, forgetting them if the reset duration has passed and making room for new
+// keys when the limit is reached
+func (l *LockoutTracker) tracked(key string, now time.Time) *loginFailures {
+	failures, ok := l.failures[key]
+	if ok {
+		if failures.count > 0 && now.Sub(failures.last) > l.Reset {
+			failures.count = 0
+		}
+		return failures
+	}
+	if len(l.failures) >= lockoutLimit {
+		// Failures past the reset duration are already forgotten, and keys with an attempt in progress are kept so it
+		// still counts
+		pruneIdle(l.failures, lockoutLimit, now, l.Reset, func(failures *loginFailures) (time.Time, bool) {
+			return failures.last, failures.pending == 0
+		})
+	}
+	failures = &loginFailures{last: now}
+	l.failures[key] = failures
+	return failures
+}
+
+func (l *LockoutTracker) retryAfter(key string, now time.Time) time.Duration {
+	failures, ok := l.failures[key]
+	if !ok || failures.count < l.Threshold {
+		return 0
+	}
+	backoff := l.Max
+	if doublings := failures.count - l.Threshold; doublings < 32 {
+		backoff = min(l.Backoff<<doublings, l.Max)
+	}
+	return failures.last.Add(backoff).Sub(now)
+}
+
+func userLockoutKey(user string) string {
+	return "user " + user
+}
+
+func ipLockoutKey(ip string) string {
+	return "ip " + ip
+}
+
+// ParseTrustedProxies parses a comma separated list of IPs and CIDRs
+func ParseTrustedProxies(input string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, proxy := range strings.Split(input, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", proxy)
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", proxy)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// clientIP returns the IP of the client making the request. If the connection is from a trusted proxy the
+// X-Forwarded-For header is walked from the right, skipping trusted proxies, to find the first untrusted address.
+func clientIP(request *http.Request, trustedProxies []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		ip = request.RemoteAddr
+	}
+	if !isTrustedProxy(trustedProxies, ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(request.Header.Values("X-Forwarded-For"), ","), ",")
+	for index := len(forwarded) - 1; index >= 0; index-- {
+		address := strings.TrimSpace(forwarded[index])
+		if net.ParseIP(address) == nil {
+			break
+		}
+		ip = address
+		if !isTrustedProxy(trustedProxies, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func isTrustedProxy(trustedProxies []*net.IPNet, address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestLockoutTracker(t *testing.T) {
+	tracker := NewLockoutTracker(2, time.Minute, 4*time.Minute, time.Hour)
+	fail := func(user string, ip string) {
+		t.Helper()
+		if err := tracker.Attempt(user, ip); err != nil {
+			t.Fatalf("Attempt() before failure = %v, want nil", err)
+		}
+		tracker.Failed(user, ip)
+	}
+	fail("user", "10.0.0.1")
+	if err := tracker.Attempt("user", "10.0.0.1"); err != nil {
+		t.Errorf("Attempt() after 1 failure = %v, want nil", err)
+	}
+	tracker.Failed("user", "10.0.0.1")
+	var locked *LockedError
+	if err := tracker.Attempt("user", "10.0.0.2"); !errors.As(err, &locked) || locked.RetryAfter <= 0 || locked.RetryAfter > time.Minute {
+		t.Errorf("Attempt() user after 2 failures = %v, want locked for a minute", err)
+	}
+	if err := tracker.Attempt("other", "10.0.0.1"); err == nil {
+		t.Errorf("Attempt() ip after 2 failures = nil, want locked")
+	}
+	for range 5 {
+		tracker.Failed("user", "10.0.0.1")
+	}
+	if err := tracker.Attempt("user", "10.0.0.2"); !errors.As(err, &locked) || locked.RetryAfter <= 3*time.Minute || locked.RetryAfter > 4*time.Minute {
+		t.Errorf("Attempt() user after 7 failures = %v, want locked for the maximum", err)
+	}
+	tracker.Clear("user", "")
+	if err := tracker.Attempt("user", "10.0.0.2"); err != nil {
+		t.Errorf("Attempt() user after clear = %v, want nil", err)
+	}
+	tracker.Succeeded("user", "10.0.0.2")
+	if err := tracker.Attempt("other", "10.0.0.1"); err == nil {
+		t.Errorf("Attempt() ip after another ip succeeded = nil, want locked")
+	}
+	tracker.Clear("", "10.0.0.1")
+	if err := tracker.Attempt("other", "10.0.0.1"); err != nil {
+		t.Errorf("Attempt() ip after clear = %v, want nil", err)
+	}
+	tracker.Succeeded("other", "10.0.0.1")
+	if len(tracker.failures) != 0 {
+		t.Errorf("Succeeded() left %d tracked keys, want 0", len(tracker.failures))
+	}
+	if NewLockoutTracker(0, time.Minute, time.Minute, time.Minute) != nil {
+		t.Errorf("NewLockoutTracker() with no threshold should be disabled")
+	}
+}
+
+func TestLockoutTracker_ConcurrentAttempts(t *testing.T) {
+	tracker := NewLockoutTracker(3, time.Minute, time.Minute, time.Hour)
+	tracker.Failed("user", "10.0.0.1")
+	for index := range 3 {
+		err := tracker.Attempt("user", "10.0.0.2")
+		if (err == nil) != (index < 2) {
+			t.Errorf("Attempt() %d in progress = %v, want allowed %v", index, err, index < 2)
+		}
+	}
+	tracker.Succeeded("user", "10.0.0.2")
+	if err := tracker.Attempt("other", "10.0.0.2"); err != nil {
+		t.Errorf("Attempt() after success = %v, want nil", err)
+	}
+}
+
+func TestLockoutTracker_Limit(t *testing.T) {
+	tracker := NewLockoutTracker(3, time.Minute, time.Minute, time.Hour)
+	for index := range lockoutLimit + 10 {
+		tracker.Failed(strconv.Itoa(index), "10.0.0.1")
+	}
+	if len(tracker.failures) > lockoutLimit {
+		t.Errorf("Failed() tracked %d keys, want at most %d", len(tracker.failures), lockoutLimit)
+	}
+	if err := tracker.Attempt("new", "10.0.0.1"); err == nil {
+		t.Errorf("Attempt() ip after spray = nil, want locked")
+	}
+}
+
+func Test_clientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies() error = %v", err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{name: "Direct", remoteAddr: "1.2.3.4:1234", want: "1.2.3.4"},
+		{name: "Untrusted proxy", remoteAddr: "1.2.3.4:1234", forwarded: []string{"5.6.7.8"}, want: "1.2.3.4"},
+		{name: "Trusted proxy", remoteAddr: "10.1.1.1:1234", forwarded: []string{"5.6.7.8"}, want: "5.6.7.8"},
+		{name: "Spoofed header", remoteAddr: "10.1.1.1:1234", forwarded: []string{"9.9.9.9, 5.6.7.8"}, want: "5.6.7.8"},
+		{name: "Chained proxies", remoteAddr: "10.1.1.1:1234", forwarded: []string{"5.6.7.8, 192.168.1.1", "10.2.2.2"}, want: "5.6.7.8"},
+		{name: "Only proxies", remoteAddr: "10.1.1.1:1234", forwarded: []string{"192.168.1.1"}, want: "192.168.1.1"},
+		{name: "Invalid header", remoteAddr: "10.1.1.1:1234", forwarded: []string{"unknown"}, want: "10.1.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/auth", nil)
+			request.RemoteAddr = tt.remoteAddr
+			for _, forwarded := range tt.forwarded {
+				request.Header.Add("X-Forwarded-For", forwarded)
+			}
+			if got := clientIP(request, proxies); got != tt.want {
+				t.Errorf("clientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, err = ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Errorf("ParseTrustedProxies() expected error for invalid cidr")
+	}
+}
+
+func TestServer_HandleAuthLockout(t *testing.T) {
+	server := newTestServer(t)
+	server.Router = mux.NewRouter()
+	server.AdminGroup = "admin"
+	server.Authenticators = AuthenticatorChain{NewStaticAuthenticator(map[string]string{"test": testPasswordHash, "admin": testPasswordHash})}
+	server.Groups = map[string][]string{"admin": {"admin"}}
+	server.Lockouts = NewLockoutTracker(2, time.Minute, time.Hour, time.Hour)
+	server.addAdminRoutes()
+	login := func(user string, password string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/auth?service=service&scope=repository:private/app:pull", nil)
+		request.RemoteAddr = "1.2.3.4:1234"
+		request.SetBasicAuth(user, password)
+		recorder := httptest.NewRecorder()
+		server.HandleAuth(recorder, request)
+		return recorder
+	}
+	if code := login("test", "wrong").Code; code != http.StatusOK {
+		t.Errorf("HandleAuth() first failure = %d, want %d", code, http.StatusOK)
+	}
+	login("TEST", "wrong")
+	recorder := login("test", "test")
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "60" {
+		t.Fatalf("HandleAuth() while locked = %d, Retry-After = %s", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/admin/unlock", strings.NewReader(`{"user":"Test","ip":"1.2.3.4"}`))
+	request.SetBasicAuth("admin", "test")
+	recorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("unlock = %d, want %d", recorder.Code, http.StatusNoContent)
+	}
+	if code := login("test", "test").Code; code != http.StatusOK {
+		t.Errorf("HandleAuth() after unlock = %d, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth/token"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	RefreshTokenExpiry = flag.Duration("refresh-token-expiry", 30*24*time.Hour, "How long refresh tokens issued to OAuth2 clients are valid for")
+)
+
+// refreshTokenAudience is used as the audience of refresh tokens so that a registry will never accept one as an
+// access token
+const refreshTokenAudience = "urn:registryauth:refresh"
+
+// RefreshClaims are the claims of a long-lived refresh token, which can only be exchanged for access tokens
+type RefreshClaims struct {
+	Issuer     string `json:"iss"`
+	Subject    string `json:"sub"`
+	Audience   string `json:"aud"`
+	Expiration int64  `json:"exp"`
+	IssuedAt   int64  `json:"iat"`
+	JWTID      string `json:"jti"`
+	Service    string `json:"service"`
+	ClientID   string `json:"client_id"`
+	Token      string `json:"token,omitempty"`
+}
+
+type oauthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func isOAuthRequest(request *http.Request) bool {
+	return request.Method == http.MethodPost && request.FormValue("grant_type") != ""
+}
+
+// HandleOAuth implements the OAuth2 password and refresh_token grants from the distribution token spec
+func (s *Server) HandleOAuth(writer http.ResponseWriter, request *http.Request) {
+	clientID := request.FormValue("client_id")
+	if clientID == "" {
+		s.audit(request, nil, auditInvalidRequest)
+		writeOAuthError(writer, http.StatusBadRequest, "invalid_request", "client_id is required")
+		return
+	}
+	registry, err := s.registryFor(parseRequestService(request))
+	if err != nil {
+		s.audit(request, nil, auditUnknownService)
+		writeOAuthError(writer, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	var authRequest *Request
+	var refreshToken string
+	grantType := request.FormValue("grant_type")
+	switch grantType {
+	case "password":
+		authRequest, err = s.parseRequest(request, registry)
+		if err != nil {
+			s.audit(request, nil, throttledReason(err))
+			writeOAuthTooManyRequests(writer, err)
+			return
+		}
+		if !authRequest.validCredentials {
+			log.Infof("authenticate failed: %s", authRequest.User)
+			s.audit(request, authRequest, auditAuthenticationFailed)
+			writeOAuthError(writer, http.StatusUnauthorized, "invalid_grant", "invalid username or password")
+			return
+		}
+	case "refresh_token":
+		refreshToken = request.FormValue("refresh_token")
+		claims, err := s.parseRefreshToken(refreshToken)
+		if err != nil {
+			log.Infof("refresh token rejected: %s", err)
+			s.audit(request, nil, auditInvalidRefreshToken)
+			writeOAuthError(writer, http.StatusUnauthorized, "invalid_grant", "invalid refresh token")
+			return
+		}
+		authRequest = &Request{
+			User:           claims.Subject,
+			Service:        registry.Service,
+			RequestedScope: parseScope(parseRequestScope(request)),
+			ClientID:       clientID,
+			RemoteAddr:     request.RemoteAddr,
+			ClientIP:       clientIP(request, s.TrustedProxies),
+			UserAgent:      request.UserAgent(),
+		}
+		err = s.RateLimits.Allow(authRequest.User, authRequest.ClientIP)
+		if err != nil {
+			s.audit(request, authRequest, throttledReason(err))
+			writeOAuthTooManyRequests(writer, err)
+			return
+		}
+		identity, err := s.authenticators(registry).Refresh(claims.Subject, claims.Token)
+		if err != nil {
+			log.Infof("refresh token rejected: %s", err)
+			s.audit(request, authRequest, auditInvalidRefreshToken)
+			writeOAuthError(writer, http.StatusUnauthorized, "invalid_grant", "invalid refresh token")
+			return
+		}
+		authRequest.setIdentity(identity, s.Groups)
+		if claims.Service != authRequest.Service {
+			log.Infof("refresh token for %s used for service %s", claims.Service, authRequest.Service)
+			s.audit(request, authRequest, auditInvalidRefreshToken)
+			writeOAuthError(writer, http.StatusUnauthorized, "invalid_grant", "refresh token not valid for service")
+			return
+		}
+		if claims.ClientID != authRequest.ClientID {
+			log.Infof("refresh token for client %s used by client %s", claims.ClientID, authRequest.ClientID)
+			s.audit(request, authRequest, auditInvalidRefreshToken)
+			writeOAuthError(writer, http.StatusUnauthorized, "invalid_grant", "refresh token not valid for client")
+			return
+		}
+	default:
+		s.audit(request, nil, auditInvalidRequest)
+		writeOAuthError(writer, http.StatusBadRequest, "unsupported_grant_type", fmt.Sprintf("unsupported grant type: %s", grantType))
+		return
+	}
+	authRequest.Service = registry.Service
+	err = authRequest.getApprovedScope(registry.Authorizer, registry.PublicPrefixes)
+	if errors.Is(err, errAuthenticationFailed) {
+		s.audit(request, authRequest, auditAuthenticationFailed)
+		writeOAuthError(writer, http.StatusUnauthorized, "invalid_grant", err.Error())
+		return
+	}
+	if err != nil {
+		s.audit(request, authRequest, auditError)
+		http.Error(writer, "authorise failed", http.StatusServiceUnavailable)
+		return
+	}
+	lifetime := registry.TokenLifetimes.forRequest(authRequest)
+	issuedAt := time.Now()
+	accessToken, err := authRequest.getResponseToken(registry.publicKey, registry.privateKey, registry.Issuer, lifetime, issuedAt)
+	if err != nil {
+		s.audit(request, authRequest, auditError)
+		http.Error(writer, "authorise failed", http.StatusInternalServerError)
+		return
+	}
+	if grantType == "password" && request.FormValue("access_type") == "offline" && !authRequest.refreshable {
+		log.Infof("Not issuing refresh token to user that can't be refreshed: %s", authRequest.User)
+	} else if grantType == "password" && request.FormValue("access_type") == "offline" {
+		refreshToken, err = s.createRefreshToken(authRequest, registry, clientID, issuedAt)
+		if err != nil {
+			log.Errorf("Unable to create refresh token: %s", err)
+			s.audit(request, authRequest, auditError)
+			http.Error(writer, "authorise failed", http.StatusInternalServerError)
+			return
+		}
+	}
+	s.audit(request, authRequest, grantReason(authRequest))
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(writer).Encode(&Response{
+		Token:        accessToken,
+		AccessToken:  accessToken,
+		ExpiresIn:    int(lifetime.Expiry.Seconds()),
+		IssuedAt:     issuedAt.UTC().Format(time.RFC3339),
+		Scope:        formatScope(authRequest.ApprovedScope),
+		RefreshToken: refreshToken,
+	})
+}
+
+func (s *Server) createRefreshToken(request *Request, registry *Registry, clientID string, issuedAt time.Time) (string, error) {
+	log.Debugf("Creating refresh token for user: %s, service: %s, client: %s", request.User, request.Service, clientID)
+	claims := RefreshClaims{
+		Issuer:     registry.Issuer,
+		Subject:    request.User,
+		Audience:   refreshTokenAudience,
+		Expiration: issuedAt.Add(s.refreshTokenExpiry()).Unix(),
+		IssuedAt:   issuedAt.Unix(),
+		JWTID:      newJWTID(issuedAt),
+		Service:    request.Service,
+		ClientID:   clientID,
+	}
+	if request.apiToken != nil {
+		claims.Token = request.apiToken.Name
+	}
+	return signClaims(registry.publicKey, registry.privateKey, claims)
+}
+
+func (s *Server) refreshTokenExpiry() time.Duration {
+	if s.RefreshExpiry <= 0 {
+		return *RefreshTokenExpiry
+	}
+	return s.RefreshExpiry
+}
+
+// parseRefreshToken validates a refresh token, the user it was issued to still needs to be refreshed by an
+// authenticator before it can be used
+func (s *Server) parseRefreshToken(refreshToken string) (*RefreshClaims, error) {
+	claims := &RefreshClaims{}
+	err := s.verifySigned(refreshToken, claims)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Audience != refreshTokenAudience {
+		return nil, errors.New("not a refresh token")
+	}
+	if registry := s.registry(claims.Service); registry == nil || claims.Issuer != registry.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %s for service %s", claims.Issuer, claims.Service)
+	}
+	if time.Now().Unix() > claims.Expiration {
+		return nil, errors.New("refresh token expired")
+	}
+	if s.Revocations.IsRevoked(claims.JWTID, claims.Subject, time.Unix(claims.IssuedAt, 0)) {
+		return nil, errors.New("refresh token revoked")
+	}
+	return claims, nil
+}
+
+func formatScope(scopes []*token.ResourceActions) string {
+	return strings.Join(scopeStrings(scopes), " ")
+}
+
+func scopeStrings(scopes []*token.ResourceActions) []string {
+	formatted := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		formatted = append(formatted, fmt.Sprintf("%s:%s:%s", scope.Type, scope.Name, strings.Join(scope.Actions, ",")))
+	}
+	return formatted
+}
+
+// writeOAuthTooManyRequests responds to a request from a locked out or rate limited user or client
+func writeOAuthTooManyRequests(writer http.ResponseWriter, err error) {
+	writer.Header().Set("Retry-After", retryAfter(err))
+	writeOAuthError(writer, http.StatusTooManyRequests, "invalid_request", err.Error())
+}
+
+func writeOAuthError(writer http.ResponseWriter, status int, code string, description string) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	_ = json.NewEncoder(writer).Encode(&oauthError{
+		Error:       code,
+		Description: description,
+	})
+}
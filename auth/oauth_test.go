@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func postOAuth(server *Server, form url.Values) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	server.HandleAuth(recorder, request)
+	return recorder
+}
+
+func TestServer_HandleOAuth(t *testing.T) {
+	server := newTestServer(t)
+	server.Registries = map[string]*Registry{"other": {Service: "other", Issuer: "issuer", Authorizer: server.Authorizer}}
+	recorder := postOAuth(server, url.Values{
+		"grant_type":  {"password"},
+		"client_id":   {"test-client"},
+		"access_type": {"offline"},
+		"service":     {"service"},
+		"username":    {"test"},
+		"password":    {"test"},
+	})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("password grant status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	response := &Response{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+		t.Fatalf("unable to parse response: %v", err)
+	}
+	if response.AccessToken == "" || response.RefreshToken == "" {
+		t.Fatalf("password grant access_token = %s, refresh_token = %s", response.AccessToken, response.RefreshToken)
+	}
+
+	recorder = postOAuth(server, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {"test-client"},
+		"service":       {"service"},
+		"refresh_token": {response.RefreshToken},
+		"scope":         {"repository:private/test:pull,push"},
+	})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("refresh grant status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	refreshed := &Response{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), refreshed); err != nil {
+		t.Fatalf("unable to parse response: %v", err)
+	}
+	if refreshed.Scope != "repository:private/test:pull,push" {
+		t.Errorf("refresh grant scope = %s", refreshed.Scope)
+	}
+	if refreshed.RefreshToken != response.RefreshToken {
+		t.Errorf("refresh grant did not return the same refresh token")
+	}
+
+	tests := []struct {
+		name       string
+		form       url.Values
+		wantStatus int
+		wantError  string
+	}{
+		{
+			name:       "Missing client_id",
+			form:       url.Values{"grant_type": {"password"}, "username": {"test"}, "password": {"test"}},
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid_request",
+		},
+		{
+			name:       "Unsupported grant",
+			form:       url.Values{"grant_type": {"authorization_code"}, "client_id": {"test-client"}},
+			wantStatus: http.StatusBadRequest,
+			wantError:  "unsupported_grant_type",
+		},
+		{
+			name:       "Wrong password",
+			form:       url.Values{"grant_type": {"password"}, "client_id": {"test-client"}, "username": {"test"}, "password": {"wrong"}},
+			wantStatus: http.StatusUnauthorized,
+			wantError:  "invalid_grant",
+		},
+		{
+			name:       "Access token used as refresh token",
+			form:       url.Values{"grant_type": {"refresh_token"}, "client_id": {"test-client"}, "service": {"service"}, "refresh_token": {response.AccessToken}},
+			wantStatus: http.StatusUnauthorized,
+			wantError:  "invalid_grant",
+		},
+		{
+			name:       "Refresh token for another service",
+			form:       url.Values{"grant_type": {"refresh_token"}, "client_id": {"test-client"}, "service": {"other"}, "refresh_token": {response.RefreshToken}},
+			wantStatus: http.StatusUnauthorized,
+			wantError:  "invalid_grant",
+		},
+		{
+			name:       "Refresh token for another client",
+			form:       url.Values{"grant_type": {"refresh_token"}, "client_id": {"other-client"}, "service": {"service"}, "refresh_token": {response.RefreshToken}},
+			wantStatus: http.StatusUnauthorized,
+			wantError:  "invalid_grant",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := postOAuth(server, tt.form)
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("HandleOAuth() status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			got := &oauthError{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), got); err != nil {
+				t.Fatalf("unable to parse response: %v", err)
+			}
+			if got.Error != tt.wantError {
+				t.Errorf("HandleOAuth() error = %s, want %s", got.Error, tt.wantError)
+			}
+		})
+	}
+
+	server.Authenticators = AuthenticatorChain{NewStaticAuthenticator(map[string]string{})}
+	recorder = postOAuth(server, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {"test-client"},
+		"service":       {"service"},
+		"refresh_token": {response.RefreshToken},
+	})
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("refresh grant for removed user status = %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+}
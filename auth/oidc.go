@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	OIDCIssuer        = flag.String("oidc-issuer", "", "Issuer URL of an OIDC provider whose ID tokens or JWT access tokens can be used as passwords")
+	OIDCAudience      = flag.String("oidc-audience", "", "Comma separated list of audiences accepted in OIDC tokens")
+	OIDCUsernameClaim = flag.String("oidc-username-claim", "email", "OIDC claim that must match the username")
+	OIDCGroupsClaim   = flag.String("oidc-groups-claim", "groups", "OIDC claim listing the user's groups")
+)
+
+// oidcKeyRefreshInterval limits how often the JWKS is fetched when a token has an unknown key ID
+const oidcKeyRefreshInterval = time.Minute
+
+var oidcAlgorithms = []jose.SignatureAlgorithm{jose.RS256, jose.RS384, jose.RS512, jose.ES256, jose.ES384, jose.ES512, jose.PS256}
+
+// OIDCAuthenticator accepts tokens issued by an OIDC provider as passwords, the provider's keys are discovered from its
+// issuer URL and the token's username claim must match the username given
+type OIDCAuthenticator struct {
+	Issuer        string
+	Audiences     []string
+	UsernameClaim string
+	GroupsClaim   string
+	client        *http.Client
+	lock          sync.Mutex
+	jwksURL       string
+	keys          *jose.JSONWebKeySet
+	lastFetch     time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+func NewOIDCAuthenticator(issuer string, audiences string, usernameClaim string, groupsClaim string) (*OIDCAuthenticator, error) {
+	if issuer == "" {
+		return nil, nil
+	}
+	authenticator := &OIDCAuthenticator{
+		Issuer:        issuer,
+		UsernameClaim: usernameClaim,
+		GroupsClaim:   groupsClaim,
+		client:        &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, audience := range strings.Split(audiences, ",") {
+		if audience = strings.TrimSpace(audience); audience != "" {
+			authenticator.Audiences = append(authenticator.Audiences, audience)
+		}
+	}
+	if len(authenticator.Audiences) == 0 {
+		return nil, errors.New("at least one oidc audience is required")
+	}
+	return authenticator, nil
+}
+
+// looksLikeJWT avoids contacting the provider for passwords that can't be tokens
+func looksLikeJWT(password string) bool {
+	return strings.Count(password, ".") == 2
+}
+
+// Authenticate validates the token and checks it belongs to the user, returning the user's groups. OIDCAuthenticator
+// isn't a Refresher, so a password grant with a provider token only returns an access token.
+func (o *OIDCAuthenticator) Authenticate(user string, rawToken string) (*Identity, error) {
+	if user == "" || !looksLikeJWT(rawToken) {
+		return nil, nil
+	}
+	parsed, err := jwt.ParseSigned(rawToken, oidcAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := o.keySet(parsed, false)
+	if err != nil {
+		return nil, err
+	}
+	claims := jwt.Claims{}
+	extra := map[string]any{}
+	err = parsed.Claims(keys, &claims, &extra)
+	if err != nil {
+		keys, err = o.keySet(parsed, true)
+		if err != nil {
+			return nil, err
+		}
+		err = parsed.Claims(keys, &claims, &extra)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = claims.Validate(jwt.Expected{
+		Issuer:      o.Issuer,
+		AnyAudience: o.Audiences,
+		Time:        time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	username, _ := extra[o.UsernameClaim].(string)
+	if username == "" || username != user {
+		return nil, fmt.Errorf("oidc %s claim %q does not match user %s", o.UsernameClaim, username, user)
+	}
+	return &Identity{User: user, Groups: o.groups(extra)}, nil
+}
+
+func (o *OIDCAuthenticator) groups(extra map[string]any) []string {
+	var groups []string
+	switch value := extra[o.GroupsClaim].(type) {
+	case string:
+		groups = append(groups, value)
+	case []any:
+		for _, group := range value {
+			if name, ok := group.(string); ok {
+				groups = append(groups, name)
+			}
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// keySet returns the provider's keys, fetching them if they haven't been yet, or if refresh is requested because
+// the token's key wasn't found
+func (o *OIDCAuthenticator) keySet(parsed *jwt.JSONWebToken, refresh bool) (*jose.JSONWebKeySet, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.keys != nil && (!refresh || time.Since(o.lastFetch) < oidcKeyRefreshInterval) {
+		return o.keys, nil
+	}
+	if refresh && len(parsed.Headers) > 0 {
+		log.Debugf("Refreshing oidc keys for key ID: %s", parsed.Headers[0].KeyID)
+	}
+	if o.jwksURL == "" {
+		discovery := &oidcDiscovery{}
+		err := o.getJSON(strings.TrimSuffix(o.Issuer, "/")+"/.well-known/openid-configuration", discovery)
+		if err != nil {
+			return nil, fmt.Errorf("oidc discovery failed: %w", err)
+		}
+		if discovery.Issuer != o.Issuer {
+			return nil, fmt.Errorf("oidc discovery issuer mismatch: %s", discovery.Issuer)
+		}
+		o.jwksURL = discovery.JWKSURI
+	}
+	keys := &jose.JSONWebKeySet{}
+	err := o.getJSON(o.jwksURL, keys)
+	if err != nil {
+		return nil, fmt.Errorf("oidc jwks fetch failed: %w", err)
+	}
+	o.keys = keys
+	o.lastFetch = time.Now()
+	return o.keys, nil
+}
+
+func (o *OIDCAuthenticator) getJSON(url string, target any) error {
+	response, err := o.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad response code: %d", response.StatusCode)
+	}
+	return json.NewDecoder(response.Body).Decode(target)
+}
@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// fakeIssuer is a local OIDC provider serving discovery and JWKS documents and signing tokens
+type fakeIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	keyID  string
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	issuer := &fakeIssuer{key: key, keyID: "test-key"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(writer http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(writer).Encode(&oidcDiscovery{
+			Issuer:  issuer.server.URL,
+			JWKSURI: issuer.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(writer http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(writer).Encode(&jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &issuer.key.PublicKey, KeyID: issuer.keyID, Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func (f *fakeIssuer) sign(t *testing.T, claims jwt.Claims, extra map[string]any) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: f.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", f.keyID))
+	if err != nil {
+		t.Fatalf("unable to create signer: %v", err)
+	}
+	signed, err := jwt.Signed(signer).Claims(claims).Claims(extra).Serialize()
+	if err != nil {
+		t.Fatalf("unable to sign token: %v", err)
+	}
+	return signed
+}
+
+func TestOIDCAuthenticator_Authenticate(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	now := time.Now()
+	validClaims := func() jwt.Claims {
+		return jwt.Claims{
+			Issuer:   issuer.server.URL,
+			Subject:  "1234",
+			Audience: jwt.Audience{"registry"},
+			Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+			IssuedAt: jwt.NewNumericDate(now),
+		}
+	}
+	userClaims := map[string]any{"email": "alice@example.com", "groups": []string{"staff", "release"}}
+	tests := []struct {
+		name       string
+		user       string
+		claims     func() jwt.Claims
+		extra      map[string]any
+		wantGroups []string
+		wantErr    bool
+	}{
+		{
+			name:       "Valid token",
+			user:       "alice@example.com",
+			claims:     validClaims,
+			extra:      userClaims,
+			wantGroups: []string{"release", "staff"},
+		},
+		{
+			name:    "Username mismatch",
+			user:    "bob@example.com",
+			claims:  validClaims,
+			extra:   userClaims,
+			wantErr: true,
+		},
+		{
+			name: "Wrong audience",
+			user: "alice@example.com",
+			claims: func() jwt.Claims {
+				claims := validClaims()
+				claims.Audience = jwt.Audience{"other"}
+				return claims
+			},
+			extra:   userClaims,
+			wantErr: true,
+		},
+		{
+			name: "Wrong issuer",
+			user: "alice@example.com",
+			claims: func() jwt.Claims {
+				claims := validClaims()
+				claims.Issuer = "https://evil.example.com"
+				return claims
+			},
+			extra:   userClaims,
+			wantErr: true,
+		},
+		{
+			name: "Expired",
+			user: "alice@example.com",
+			claims: func() jwt.Claims {
+				claims := validClaims()
+				claims.Expiry = jwt.NewNumericDate(now.Add(-time.Hour))
+				return claims
+			},
+			extra:   userClaims,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator, err := NewOIDCAuthenticator(issuer.server.URL, "registry, other-client", "email", "groups")
+			if err != nil {
+				t.Fatalf("NewOIDCAuthenticator() error = %v", err)
+			}
+			got, err := authenticator.Authenticate(tt.user, issuer.sign(t, tt.claims(), tt.extra))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got.Groups, tt.wantGroups) {
+				t.Errorf("Authenticate() = %v, want %v", got.Groups, tt.wantGroups)
+			}
+		})
+	}
+}
+
+func TestServer_HandleOAuthOIDC(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	server := newTestServer(t)
+	oidcAuthenticator, _ := NewOIDCAuthenticator(issuer.server.URL, "registry", "email", "groups")
+	server.Authenticators = append(server.Authenticators, oidcAuthenticator)
+	idToken := issuer.sign(t, jwt.Claims{
+		Issuer:   issuer.server.URL,
+		Audience: jwt.Audience{"registry"},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}, map[string]any{"email": "alice@example.com"})
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/auth?service=service", nil)
+	request.SetBasicAuth("alice@example.com", idToken)
+	server.HandleAuth(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("HandleAuth() status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	recorder = postOAuth(server, map[string][]string{
+		"grant_type":  {"password"},
+		"client_id":   {"test-client"},
+		"access_type": {"offline"},
+		"service":     {"service"},
+		"username":    {"alice@example.com"},
+		"password":    {idToken},
+	})
+	response := &Response{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+		t.Fatalf("unable to parse response: %v", err)
+	}
+	if response.AccessToken == "" || response.RefreshToken != "" {
+		t.Errorf("HandleOAuth() access_token = %s, refresh_token = %s", response.AccessToken, response.RefreshToken)
+	}
+}
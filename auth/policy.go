@@ -0,0 +1,490 @@
+package auth
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/distribution/distribution/v3/registry/auth/token"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	PolicyFile = flag.String("policy", "", "Path to a yaml file of expression based rules that requested actions must be allowed by")
+)
+
+// Policy is a list of rules evaluated for each requested action, an action is approved if any allow rule matches it
+// and no deny rule does
+type Policy []*PolicyRule
+
+// PolicyRule has an allow or deny expression, eg `user.groups contains "release" && repo.name startsWith "prod/"`
+type PolicyRule struct {
+	Allow string `yaml:"allow"`
+	Deny  string `yaml:"deny"`
+	allow policyExpr
+	deny  policyExpr
+}
+
+// PolicyAuthorizer limits requests to the actions allowed by the policy
+type PolicyAuthorizer struct {
+	Policy         Policy
+	PublicPrefixes []string
+}
+
+func LoadPolicy(path string) (Policy, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(data)
+}
+
+func ParsePolicy(input []byte) (Policy, error) {
+	policy := Policy{}
+	err := yaml.UnmarshalStrict(input, &policy)
+	if err != nil {
+		return nil, err
+	}
+	for index, rule := range policy {
+		if (rule.Allow == "") == (rule.Deny == "") {
+			return nil, fmt.Errorf("policy rule %d must have one of allow or deny", index+1)
+		}
+		if rule.Allow != "" {
+			rule.allow, err = parsePolicyExpr(rule.Allow)
+		} else {
+			rule.deny, err = parsePolicyExpr(rule.Deny)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("policy rule %d: %w", index+1, err)
+		}
+	}
+	return policy, nil
+}
+
+func (p *PolicyAuthorizer) Authorize(request *Request, scopes []*token.ResourceActions) ([]*token.ResourceActions, error) {
+	return filterScopes(scopes, func(scope *token.ResourceActions) *token.ResourceActions {
+		env := &policyEnv{request: request, scope: scope, public: IsScopePublic(p.PublicPrefixes, scope)}
+		actions := make([]string, 0)
+		for _, action := range scope.Actions {
+			env.action = action
+			if p.Policy.allows(env) {
+				actions = append(actions, action)
+			}
+		}
+		if len(actions) == 0 {
+			log.Debugf("Scope rejected (policy) - User: %s, Type: %s, Name: %s", request.User, scope.Type, scope.Name)
+			return nil
+		}
+		return &token.ResourceActions{
+			Type:    scope.Type,
+			Class:   scope.Class,
+			Name:    scope.Name,
+			Actions: actions,
+		}
+	}), nil
+}
+
+func (p Policy) allows(env *policyEnv) bool {
+	allowed := false
+	for _, rule := range p {
+		if rule.deny != nil && rule.deny.eval(env).(bool) {
+			return false
+		}
+		if rule.allow != nil && !allowed {
+			allowed = rule.allow.eval(env).(bool)
+		}
+	}
+	return allowed
+}
+
+type policyType int
+
+const (
+	policyString policyType = iota
+	policyBool
+	policyList
+)
+
+func (t policyType) String() string {
+	return [...]string{"string", "bool", "list"}[t]
+}
+
+// policyEnv is what an expression is evaluated against, a single action of a requested scope
+type policyEnv struct {
+	request *Request
+	scope   *token.ResourceActions
+	action  string
+	public  bool
+}
+
+type policyVariable struct {
+	kind policyType
+	get  func(env *policyEnv) any
+}
+
+var policyVariables = map[string]policyVariable{
+	"user.name":          {policyString, func(env *policyEnv) any { return env.request.User }},
+	"user.groups":        {policyList, func(env *policyEnv) any { return env.request.Groups }},
+	"user.authenticated": {policyBool, func(env *policyEnv) any { return env.request.validCredentials }},
+	"repo.type":          {policyString, func(env *policyEnv) any { return env.scope.Type }},
+	"repo.name":          {policyString, func(env *policyEnv) any { return env.scope.Name }},
+	"repo.public":        {policyBool, func(env *policyEnv) any { return env.public }},
+	"action":             {policyString, func(env *policyEnv) any { return env.action }},
+	"service":            {policyString, func(env *policyEnv) any { return env.request.Service }},
+	"client.id":          {policyString, func(env *policyEnv) any { return env.request.ClientID }},
+}
+
+// policyExpr is a node of a parsed expression, expressions are type checked when parsed so evaluating them can't fail
+type policyExpr interface {
+	kind() policyType
+	eval(env *policyEnv) any
+}
+
+type policyLiteral struct {
+	value any
+	typ   policyType
+}
+
+func (l *policyLiteral) kind() policyType    { return l.typ }
+func (l *policyLiteral) eval(*policyEnv) any { return l.value }
+
+type policyVariableRef struct {
+	policyVariable
+}
+
+func (v *policyVariableRef) kind() policyType        { return v.policyVariable.kind }
+func (v *policyVariableRef) eval(env *policyEnv) any { return v.get(env) }
+
+type policyNot struct {
+	expr policyExpr
+}
+
+func (n *policyNot) kind() policyType        { return policyBool }
+func (n *policyNot) eval(env *policyEnv) any { return !n.expr.eval(env).(bool) }
+
+type policyBinary struct {
+	operator string
+	left     policyExpr
+	right    policyExpr
+}
+
+func (b *policyBinary) kind() policyType { return policyBool }
+
+func (b *policyBinary) eval(env *policyEnv) any {
+	switch b.operator {
+	case "&&":
+		return b.left.eval(env).(bool) && b.right.eval(env).(bool)
+	case "||":
+		return b.left.eval(env).(bool) || b.right.eval(env).(bool)
+	}
+	left, right := b.left.eval(env), b.right.eval(env)
+	switch b.operator {
+	case "==":
+		return left == right
+	case "!=":
+		return left != right
+	case "contains":
+		if list, ok := left.([]string); ok {
+			return slices.Contains(list, right.(string))
+		}
+		return strings.Contains(left.(string), right.(string))
+	case "in":
+		return slices.Contains(right.([]string), left.(string))
+	case "startsWith":
+		return strings.HasPrefix(left.(string), right.(string))
+	case "endsWith":
+		return strings.HasSuffix(left.(string), right.(string))
+	}
+	return false
+}
+
+// policyMatchesLimit is the most patterns a matches expression caches, the cache is emptied when it is reached
+const policyMatchesLimit = 1000
+
+// policyMatches matches a repository glob in which "{user}" is replaced by the requesting user's name. A literal glob
+// without "{user}" is compiled when it is parsed, otherwise the compiled patterns are cached for each user.
+type policyMatches struct {
+	left    policyExpr
+	right   policyExpr
+	pattern *regexp.Regexp
+	lock    sync.Mutex
+	cached  map[string]*regexp.Regexp
+}
+
+func newPolicyMatches(left policyExpr, right policyExpr) *policyMatches {
+	matches := &policyMatches{left: left, right: right, cached: map[string]*regexp.Regexp{}}
+	if literal, ok := right.(*policyLiteral); ok && !strings.Contains(literal.value.(string), "{user}") {
+		matches.pattern = compileUserPattern(literal.value.(string), "")
+	}
+	return matches
+}
+
+func (m *policyMatches) kind() policyType { return policyBool }
+
+func (m *policyMatches) eval(env *policyEnv) any {
+	pattern := m.pattern
+	if pattern == nil {
+		pattern = m.userPattern(m.right.eval(env).(string), env.request.User)
+	}
+	return pattern != nil && pattern.MatchString(m.left.eval(env).(string))
+}
+
+func (m *policyMatches) userPattern(glob string, user string) *regexp.Regexp {
+	if user == "" && strings.Contains(glob, "{user}") {
+		return nil
+	}
+	key := glob + "\x00" + user
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if pattern, ok := m.cached[key]; ok {
+		return pattern
+	}
+	if len(m.cached) >= policyMatchesLimit {
+		clear(m.cached)
+	}
+	pattern := compileUserPattern(glob, user)
+	m.cached[key] = pattern
+	return pattern
+}
+
+// compileUserPattern converts a repository glob into a regexp, replacing "{user}" with the user's name
+func compileUserPattern(glob string, user string) *regexp.Regexp {
+	var builder strings.Builder
+	builder.WriteString("^")
+	for index, part := range strings.Split(glob, "{user}") {
+		if index > 0 {
+			builder.WriteString(regexp.QuoteMeta(user))
+		}
+		builder.WriteString(globToRegexp(part))
+	}
+	builder.WriteString("$")
+	pattern, err := regexp.Compile(builder.String())
+	if err != nil {
+		return nil
+	}
+	return pattern
+}
+
+// policyOperators lists the types each comparison operator accepts, as pairs of left and right types
+var policyOperators = map[string][][2]policyType{
+	"==":         {{policyString, policyString}, {policyBool, policyBool}},
+	"!=":         {{policyString, policyString}, {policyBool, policyBool}},
+	"contains":   {{policyList, policyString}, {policyString, policyString}},
+	"in":         {{policyString, policyList}},
+	"startsWith": {{policyString, policyString}},
+	"endsWith":   {{policyString, policyString}},
+	"matches":    {{policyString, policyString}},
+}
+
+type policyToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizePolicy(input string) ([]policyToken, error) {
+	var tokens []policyToken
+	for index := 0; index < len(input); {
+		char := rune(input[index])
+		switch {
+		case unicode.IsSpace(char):
+			index++
+		case char == '"':
+			var builder strings.Builder
+			index++
+			for ; index < len(input) && input[index] != '"'; index++ {
+				if input[index] == '\\' && index+1 < len(input) {
+					index++
+				}
+				builder.WriteByte(input[index])
+			}
+			if index >= len(input) {
+				return nil, fmt.Errorf("unterminated string in %q", input)
+			}
+			index++
+			tokens = append(tokens, policyToken{text: builder.String(), quoted: true})
+		case strings.HasPrefix(input[index:], "&&"), strings.HasPrefix(input[index:], "||"),
+			strings.HasPrefix(input[index:], "=="), strings.HasPrefix(input[index:], "!="):
+			tokens = append(tokens, policyToken{text: input[index : index+2]})
+			index += 2
+		case strings.ContainsRune("!()[],", char):
+			tokens = append(tokens, policyToken{text: string(char)})
+			index++
+		case unicode.IsLetter(char) || char == '_':
+			start := index
+			for index < len(input) && (unicode.IsLetter(rune(input[index])) || unicode.IsDigit(rune(input[index])) ||
+				input[index] == '_' || input[index] == '.') {
+				index++
+			}
+			tokens = append(tokens, policyToken{text: input[start:index]})
+		default:
+			return nil, fmt.Errorf("unexpected character %q in %q", char, input)
+		}
+	}
+	return tokens, nil
+}
+
+// policyParser is a recursive descent parser for policy expressions:
+//
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | comparison
+//	comparison = operand [ operator operand ]
+//	operand    = string | list | "true" | "false" | variable | "(" or ")"
+type policyParser struct {
+	tokens   []policyToken
+	position int
+}
+
+func parsePolicyExpr(input string) (policyExpr, error) {
+	tokens, err := tokenizePolicy(input)
+	if err != nil {
+		return nil, err
+	}
+	parser := &policyParser{tokens: tokens}
+	expr, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.position < len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected %q", parser.tokens[parser.position].text)
+	}
+	if expr.kind() != policyBool {
+		return nil, fmt.Errorf("expression is a %s, not a bool", expr.kind())
+	}
+	return expr, nil
+}
+
+func (p *policyParser) peek() (policyToken, bool) {
+	if p.position >= len(p.tokens) {
+		return policyToken{}, false
+	}
+	return p.tokens[p.position], true
+}
+
+// accept consumes the next token if it is the given unquoted text
+func (p *policyParser) accept(text string) bool {
+	next, ok := p.peek()
+	if !ok || next.quoted || next.text != text {
+		return false
+	}
+	p.position++
+	return true
+}
+
+func (p *policyParser) parseOr() (policyExpr, error) {
+	return p.parseLogical("||", p.parseAnd)
+}
+
+func (p *policyParser) parseAnd() (policyExpr, error) {
+	return p.parseLogical("&&", p.parseUnary)
+}
+
+func (p *policyParser) parseLogical(operator string, operand func() (policyExpr, error)) (policyExpr, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(operator) {
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if left.kind() != policyBool || right.kind() != policyBool {
+			return nil, fmt.Errorf("%s requires bool operands", operator)
+		}
+		left = &policyBinary{operator: operator, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *policyParser) parseUnary() (policyExpr, error) {
+	if p.accept("!") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if expr.kind() != policyBool {
+			return nil, fmt.Errorf("! requires a bool operand")
+		}
+		return &policyNot{expr: expr}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *policyParser) parseComparison() (policyExpr, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	next, ok := p.peek()
+	if !ok || next.quoted {
+		return left, nil
+	}
+	allowed, isOperator := policyOperators[next.text]
+	if !isOperator {
+		return left, nil
+	}
+	p.position++
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(allowed, [2]policyType{left.kind(), right.kind()}) {
+		return nil, fmt.Errorf("%s can't compare a %s with a %s", next.text, left.kind(), right.kind())
+	}
+	if next.text == "matches" {
+		return newPolicyMatches(left, right), nil
+	}
+	return &policyBinary{operator: next.text, left: left, right: right}, nil
+}
+
+func (p *policyParser) parseOperand() (policyExpr, error) {
+	next, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.position++
+	if next.quoted {
+		return &policyLiteral{value: next.text, typ: policyString}, nil
+	}
+	switch next.text {
+	case "true", "false":
+		return &policyLiteral{value: next.text == "true", typ: policyBool}, nil
+	case "(":
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		return expr, nil
+	case "[":
+		list := make([]string, 0)
+		for !p.accept("]") {
+			if len(list) > 0 && !p.accept(",") {
+				return nil, fmt.Errorf("expected , or ] in list")
+			}
+			item, ok := p.peek()
+			if !ok || !item.quoted {
+				return nil, fmt.Errorf("lists can only contain strings")
+			}
+			p.position++
+			list = append(list, item.text)
+		}
+		return &policyLiteral{value: list, typ: policyList}, nil
+	}
+	if variable, ok := policyVariables[next.text]; ok {
+		return &policyVariableRef{variable}, nil
+	}
+	return nil, fmt.Errorf("unknown variable %q", next.text)
+}
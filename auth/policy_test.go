@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/auth/token"
+)
+
+const testPolicy = `
+- allow: 'user.groups contains "release" && repo.name startsWith "prod/" && action == "push"'
+- allow: 'user.authenticated && action in ["pull", "push"] && repo.name matches "users/{user}/**"'
+- allow: 'repo.public && action == "pull"'
+- allow: 'user.authenticated && action == "pull" && !(repo.name endsWith "-private")'
+- deny: 'repo.name == "prod/legacy"'
+`
+
+func TestPolicyAuthorizer_Authorize(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("ParsePolicy() error = %v", err)
+	}
+	authorizer := &PolicyAuthorizer{Policy: policy, PublicPrefixes: []string{"public"}}
+	tests := []struct {
+		name               string
+		user               string
+		groups             []string
+		validCredentials   bool
+		requested          string
+		wantApprovedScopes []*token.ResourceActions
+	}{
+		{
+			name:               "Release group push",
+			user:               "alice",
+			groups:             []string{"release"},
+			validCredentials:   true,
+			requested:          "repository:prod/app:pull,push,delete",
+			wantApprovedScopes: parseScope("repository:prod/app:pull,push"),
+		},
+		{
+			name:               "Push without group",
+			user:               "bob",
+			validCredentials:   true,
+			requested:          "repository:prod/app:push",
+			wantApprovedScopes: []*token.ResourceActions{},
+		},
+		{
+			name:               "Own user repository",
+			user:               "bob",
+			validCredentials:   true,
+			requested:          "repository:users/bob/app:pull,push",
+			wantApprovedScopes: parseScope("repository:users/bob/app:pull,push"),
+		},
+		{
+			name:               "Other user repository",
+			user:               "bob",
+			validCredentials:   true,
+			requested:          "repository:users/alice/app:push",
+			wantApprovedScopes: []*token.ResourceActions{},
+		},
+		{
+			name:               "User name is not a pattern",
+			user:               "b*",
+			validCredentials:   true,
+			requested:          "repository:users/bob/app:push",
+			wantApprovedScopes: []*token.ResourceActions{},
+		},
+		{
+			name:               "Anonymous public pull",
+			requested:          "repository:public/app:pull,push",
+			wantApprovedScopes: parseScope("repository:public/app:pull"),
+		},
+		{
+			name:               "Negated condition",
+			user:               "bob",
+			validCredentials:   true,
+			requested:          "repository:team/app-private:pull",
+			wantApprovedScopes: []*token.ResourceActions{},
+		},
+		{
+			name:               "Deny rule",
+			user:               "alice",
+			groups:             []string{"release"},
+			validCredentials:   true,
+			requested:          "repository:prod/legacy:pull,push",
+			wantApprovedScopes: []*token.ResourceActions{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := &Request{
+				User:             tt.user,
+				Groups:           tt.groups,
+				RequestedScope:   parseScope(tt.requested),
+				validCredentials: tt.validCredentials,
+			}
+			got, err := authorizer.Authorize(request, request.RequestedScope)
+			if err != nil {
+				t.Fatalf("Authorize() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.wantApprovedScopes) {
+				t.Errorf("Authorize() = %v, want %v", actionsToString(got), actionsToString(tt.wantApprovedScopes))
+			}
+		})
+	}
+}
+
+func Test_parsePolicyExpr(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "Valid", input: `service == "registry" || (client.id != "" && repo.type == "registry")`},
+		{name: "Escaped quote", input: `repo.name == "a\"b"`},
+		{name: "Unknown variable", input: `user.email == "a"`, wantErr: true},
+		{name: "Type mismatch", input: `user.groups startsWith "a"`, wantErr: true},
+		{name: "Not a bool", input: `repo.name`, wantErr: true},
+		{name: "Unterminated string", input: `repo.name == "a`, wantErr: true},
+		{name: "Missing operand", input: `repo.name ==`, wantErr: true},
+		{name: "Trailing tokens", input: `repo.public repo.public`, wantErr: true},
+		{name: "Unbalanced parentheses", input: `(repo.public`, wantErr: true},
+		{name: "Invalid list", input: `action in ["pull" "push"]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parsePolicyExpr(tt.input); (err != nil) != tt.wantErr {
+				t.Errorf("parsePolicyExpr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_policyMatches(t *testing.T) {
+	tests := []struct {
+		name         string
+		input        string
+		user         string
+		repository   string
+		want         bool
+		wantCompiled bool
+	}{
+		{name: "Glob", input: `repo.name matches "lib/*"`, repository: "lib/app", want: true, wantCompiled: true},
+		{name: "Glob single segment", input: `repo.name matches "lib/*"`, repository: "lib/a/b", wantCompiled: true},
+		{name: "User", input: `repo.name matches "users/{user}/*"`, user: "alice", repository: "users/alice/app", want: true},
+		{name: "Other user", input: `repo.name matches "users/{user}/*"`, user: "bob", repository: "users/alice/app"},
+		{name: "Anonymous user", input: `repo.name matches "users/{user}/*"`, repository: "users//app"},
+		{name: "User quoted", input: `repo.name matches "users/{user}"`, user: "a.c", repository: "users/abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := parsePolicyExpr(tt.input)
+			if err != nil {
+				t.Fatalf("parsePolicyExpr() error = %v", err)
+			}
+			matches := expr.(*policyMatches)
+			if (matches.pattern != nil) != tt.wantCompiled {
+				t.Errorf("parsePolicyExpr() compiled = %v, want %v", matches.pattern != nil, tt.wantCompiled)
+			}
+			env := &policyEnv{request: &Request{User: tt.user}, scope: &token.ResourceActions{Name: tt.repository}}
+			for range 2 {
+				if got := matches.eval(env).(bool); got != tt.want {
+					t.Errorf("eval() = %v, want %v", got, tt.want)
+				}
+			}
+			if !tt.wantCompiled && tt.user != "" && len(matches.cached) != 1 {
+				t.Errorf("eval() cached %d patterns, want 1", len(matches.cached))
+			}
+		})
+	}
+}
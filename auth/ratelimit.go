@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	RateLimitIP        = flag.Int("rate-limit-ip", 0, "Token requests allowed per minute from each client IP, 0 disables the limit")
+	RateLimitAnonymous = flag.Int("rate-limit-anonymous", 0, "Anonymous token requests allowed per minute from each client IP, 0 disables the limit")
+	RateLimitUser      = flag.Int("rate-limit-user", 0, "Token requests with credentials allowed per minute for each user, 0 disables the limit")
+)
+
+// rateLimitLimit caps the buckets kept for IPs and users, so requests from many addresses can't grow the map without
+// bound
+const rateLimitLimit = 10000
+
+// RateLimiter limits token requests per client IP, per client IP for anonymous requests and per user for requests
+// with credentials. Each limit is a number of requests per minute, which can all be used at once and are replenished
+// evenly over the minute. A nil limiter allows everything.
+type RateLimiter struct {
+	IP        int
+	Anonymous int
+	User      int
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimitedError is returned when a request exceeds a rate limit, the request can be retried after RetryAfter
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, retry after %s", e.RetryAfter.Round(time.Second))
+}
+
+func NewRateLimiter(ip int, anonymous int, user int) *RateLimiter {
+	if ip <= 0 && anonymous <= 0 && user <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		IP:        ip,
+		Anonymous: anonymous,
+		User:      user,
+		buckets:   map[string]*tokenBucket{},
+	}
+}
+
+// Allow takes a request from each limit that applies, requests without a user are anonymous
+func (r *RateLimiter) Allow(user string, ip string) error {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	if retry := r.take("ip "+ip, r.IP, now); retry > 0 {
+		return &RateLimitedError{RetryAfter: retry}
+	}
+	if user == "" {
+		if retry := r.take("anonymous "+ip, r.Anonymous, now); retry > 0 {
+			return &RateLimitedError{RetryAfter: retry}
+		}
+		return nil
+	}
+	if retry := r.take("user "+strings.ToLower(user), r.User, now); retry > 0 {
+		return &RateLimitedError{RetryAfter: retry}
+	}
+	return nil
+}
+
+// take removes a token from the bucket, returning how long until one is available if it is empty
+func (r *RateLimiter) take(key string, perMinute int, now time.Time) time.Duration {
+	if perMinute <= 0 {
+		return 0
+	}
+	perSecond := float64(perMinute) / 60
+	bucket, ok := r.buckets[key]
+	if !ok {
+		if len(r.buckets) >= rateLimitLimit {
+			// Buckets idle for a minute have refilled, so are the same as a new bucket
+			pruneIdle(r.buckets, rateLimitLimit, now, time.Minute, func(bucket *tokenBucket) (time.Time, bool) {
+				return bucket.last, true
+			})
+		}
+		bucket = &tokenBucket{tokens: float64(perMinute), last: now}
+		r.buckets[key] = bucket
+	}
+	bucket.tokens = min(float64(perMinute), bucket.tokens+now.Sub(bucket.last).Seconds()*perSecond)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / perSecond * float64(time.Second))
+}
+
+// pruneIdle removes the entries idle for longer than idle, and if that doesn't bring the map below limit the least
+// recently used entry. lastUsed returns when an entry was last used, and false if it is in use and must be kept.
+func pruneIdle[V any](entries map[string]V, limit int, now time.Time, idle time.Duration, lastUsed func(V) (time.Time, bool)) {
+	oldestKey := ""
+	var oldest time.Time
+	for key, entry := range entries {
+		last, ok := lastUsed(entry)
+		if !ok {
+			continue
+		}
+		if now.Sub(last) > idle {
+			delete(entries, key)
+			continue
+		}
+		if oldestKey == "" || last.Before(oldest) {
+			oldestKey, oldest = key, last
+		}
+	}
+	if len(entries) >= limit && oldestKey != "" {
+		delete(entries, oldestKey)
+	}
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	tests := []struct {
+		name      string
+		limiter   *RateLimiter
+		requests  [][2]string
+		wantAllow []bool
+	}{
+		{
+			name:      "Disabled",
+			limiter:   NewRateLimiter(0, 0, 0),
+			requests:  [][2]string{{"", "1.1.1.1"}, {"", "1.1.1.1"}},
+			wantAllow: []bool{true, true},
+		},
+		{
+			name:      "Per IP",
+			limiter:   NewRateLimiter(2, 0, 0),
+			requests:  [][2]string{{"", "1.1.1.1"}, {"user", "1.1.1.1"}, {"other", "1.1.1.1"}, {"", "2.2.2.2"}},
+			wantAllow: []bool{true, true, false, true},
+		},
+		{
+			name:      "Anonymous",
+			limiter:   NewRateLimiter(0, 1, 0),
+			requests:  [][2]string{{"", "1.1.1.1"}, {"", "1.1.1.1"}, {"user", "1.1.1.1"}, {"", "2.2.2.2"}},
+			wantAllow: []bool{true, false, true, true},
+		},
+		{
+			name:      "Per user",
+			limiter:   NewRateLimiter(0, 0, 1),
+			requests:  [][2]string{{"user", "1.1.1.1"}, {"user", "2.2.2.2"}, {"other", "1.1.1.1"}, {"", "1.1.1.1"}},
+			wantAllow: []bool{true, false, true, true},
+		},
+		{
+			name:      "Per user ignores case",
+			limiter:   NewRateLimiter(0, 0, 1),
+			requests:  [][2]string{{"user", "1.1.1.1"}, {"USER", "2.2.2.2"}},
+			wantAllow: []bool{true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for index, request := range tt.requests {
+				err := tt.limiter.Allow(request[0], request[1])
+				if (err == nil) != tt.wantAllow[index] {
+					t.Errorf("Allow(%s, %s) request %d = %v, want allowed %v", request[0], request[1], index, err, tt.wantAllow[index])
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiter_RetryAfter(t *testing.T) {
+	limiter := NewRateLimiter(0, 0, 60)
+	now := time.Now()
+	for range 60 {
+		if retry := limiter.take("user", 60, now); retry != 0 {
+			t.Fatalf("take() = %v, want 0", retry)
+		}
+	}
+	if retry := limiter.take("user", 60, now); retry != time.Second {
+		t.Errorf("take() when empty = %v, want %v", retry, time.Second)
+	}
+	if retry := limiter.take("user", 60, now.Add(time.Second)); retry != 0 {
+		t.Errorf("take() after refill = %v, want 0", retry)
+	}
+	var limited *RateLimitedError
+	for range 60 {
+		_ = limiter.Allow("other", "1.1.1.1")
+	}
+	if err := limiter.Allow("other", "1.1.1.1"); !errors.As(err, &limited) || limited.RetryAfter <= 0 {
+		t.Errorf("Allow() = %v, want rate limited", err)
+	}
+}
+
+func TestRateLimiter_Limit(t *testing.T) {
+	limiter := NewRateLimiter(2*rateLimitLimit, 0, 1)
+	start := time.Now()
+	for index := range rateLimitLimit + 10 {
+		now := start.Add(time.Duration(index))
+		if retry := limiter.take("ip 1.1.1.1", limiter.IP, now); retry != 0 {
+			t.Fatalf("take() ip request %d = %v, want 0", index, retry)
+		}
+		_ = limiter.take("user "+strconv.Itoa(index), limiter.User, now)
+	}
+	if len(limiter.buckets) > rateLimitLimit {
+		t.Errorf("take() tracked %d buckets, want at most %d", len(limiter.buckets), rateLimitLimit)
+	}
+	if bucket, ok := limiter.buckets["ip 1.1.1.1"]; !ok || bucket.tokens >= rateLimitLimit {
+		t.Errorf("take() dropped the bucket of the ip in use")
+	}
+}
+
+func TestServer_HandleAuthRateLimit(t *testing.T) {
+	server := newTestServer(t)
+	server.RateLimits = NewRateLimiter(0, 1, 0)
+	request := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		server.HandleAuth(recorder, httptest.NewRequest(http.MethodGet, "/auth?service=service&scope=repository:public/app:pull", nil))
+		return recorder
+	}
+	if code := request().Code; code != http.StatusOK {
+		t.Fatalf("HandleAuth() first request = %d, want %d", code, http.StatusOK)
+	}
+	recorder := request()
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "60" {
+		t.Errorf("HandleAuth() limited request = %d, Retry-After = %s", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+}
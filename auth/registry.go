@@ -0,0 +1,285 @@
+package auth
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/docker/libtrust"
+	"github.com/greboid/registryauth/certs"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ServicesFile          = flag.String("services", "", "Path to a yaml file of additional services to issue tokens for, each with its own issuer, users, public repositories, acl, policy, signing key and token lifetimes")
+	RewriteUnknownService = flag.Bool("rewrite-unknown-service", false, "Issue tokens for the default service when an unknown service is requested, rather than rejecting the request")
+)
+
+// Registry is a service that tokens are issued for, tokens have the service as their audience. Services can have
+// their own users, which are tried before the top level authenticators, and their own signing key and token lifetimes,
+// which default to the top level ones.
+type Registry struct {
+	Service        string
+	Issuer         string
+	PublicPrefixes []string
+	Authorizer     Authorizer
+	Authenticators AuthenticatorChain
+	TokenLifetimes *TokenLifetimes
+	CertPath       string
+	KeyPath        string
+	// RegistryHost is the URL of the registry, used to list its public repositories
+	RegistryHost string
+	publicKey    libtrust.PublicKey
+	privateKey   libtrust.PrivateKey
+	bundleKeys   []libtrust.PublicKey
+}
+
+// RegistryConfig configures an additional service. The issuer, ACL, policy, signing key and token lifetimes default to
+// the top level configuration when not set, while the users and public repositories are only the service's own.
+type RegistryConfig struct {
+	Issuer         string              `yaml:"issuer"`
+	Public         string              `yaml:"public"`
+	Users          map[string]string   `yaml:"users"`
+	ACL            string              `yaml:"acl"`
+	Policy         string              `yaml:"policy"`
+	CertDir        string              `yaml:"cert-dir"`
+	TokenExpiry    *time.Duration      `yaml:"token-expiry"`
+	TokenSkew      *time.Duration      `yaml:"token-skew"`
+	TokenOverrides []*LifetimeOverride `yaml:"token-overrides"`
+	RegistryHost   string              `yaml:"registry-host"`
+}
+
+// AuthorizerBuilder creates the authorizer for a service from its public repositories, ACL and policy, the ACL and
+// policy are nil if the service doesn't have its own
+type AuthorizerBuilder func(publicPrefixes []string, acl ACL, policy Policy) Authorizer
+
+// LoadRegistries loads additional services from a yaml file, the defaults provide the issuer and token lifetimes for
+// services that don't set their own, and the name of the default service which can't be configured again
+func LoadRegistries(path string, defaults *Registry, buildAuthorizer AuthorizerBuilder) (map[string]*Registry, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRegistries(data, defaults, buildAuthorizer)
+}
+
+func ParseRegistries(input []byte, defaults *Registry, buildAuthorizer AuthorizerBuilder) (map[string]*Registry, error) {
+	configs := map[string]*RegistryConfig{}
+	err := yaml.UnmarshalStrict(input, configs)
+	if err != nil {
+		return nil, err
+	}
+	registries := map[string]*Registry{}
+	for service, config := range configs {
+		if service == "" {
+			return nil, fmt.Errorf("service name is required")
+		}
+		if service == defaults.Service {
+			return nil, fmt.Errorf("service %s is the default service", service)
+		}
+		if config == nil {
+			config = &RegistryConfig{}
+		}
+		registry, err := config.registry(service, defaults, buildAuthorizer)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", service, err)
+		}
+		registries[service] = registry
+	}
+	return registries, nil
+}
+
+func (c *RegistryConfig) registry(service string, defaults *Registry, buildAuthorizer AuthorizerBuilder) (*Registry, error) {
+	registry := &Registry{
+		Service:        service,
+		Issuer:         c.Issuer,
+		TokenLifetimes: defaults.TokenLifetimes,
+		RegistryHost:   c.RegistryHost,
+	}
+	if registry.Issuer == "" {
+		registry.Issuer = defaults.Issuer
+	}
+	var err error
+	registry.PublicPrefixes, err = ParsePrefixes(c.Public)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := LoadACL(c.ACL)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := LoadPolicy(c.Policy)
+	if err != nil {
+		return nil, err
+	}
+	registry.Authorizer = buildAuthorizer(registry.PublicPrefixes, acl, policy)
+	if len(c.Users) > 0 {
+		registry.Authenticators = AuthenticatorChain{NewStaticAuthenticator(c.Users)}
+	}
+	if c.CertDir != "" {
+		registry.CertPath, registry.KeyPath = certs.CertPathsIn(c.CertDir)
+	}
+	if c.TokenExpiry != nil || c.TokenSkew != nil || c.TokenOverrides != nil {
+		lifetime := TokenLifetime{Expiry: *TokenExpiry, Skew: *TokenSkew}
+		if defaults.TokenLifetimes != nil {
+			lifetime = defaults.TokenLifetimes.Default
+		}
+		if c.TokenExpiry != nil {
+			lifetime.Expiry = *c.TokenExpiry
+		}
+		if c.TokenSkew != nil {
+			lifetime.Skew = *c.TokenSkew
+		}
+		registry.TokenLifetimes, err = NewTokenLifetimes(lifetime.Expiry, lifetime.Skew, c.TokenOverrides)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+// loadKeys generates the service's signing key if it doesn't exist and loads it, services without their own key use
+// the top level key
+func (r *Registry) loadKeys() error {
+	if r.CertPath == "" {
+		return nil
+	}
+	err := certs.GenerateSelfSignedCert(r.CertPath, r.KeyPath)
+	if err != nil {
+		return fmt.Errorf("generating certificates for %s: %s", r.Service, err.Error())
+	}
+	r.publicKey, r.privateKey, r.bundleKeys, err = loadSigningKeys(r.Service, r.CertPath, r.KeyPath)
+	if err != nil {
+		return fmt.Errorf("loading certificates for %s: %s", r.Service, err.Error())
+	}
+	return nil
+}
+
+func (s *Server) defaultRegistry() *Registry {
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+	return &Registry{
+		Service:        s.Service,
+		Issuer:         s.Issuer,
+		PublicPrefixes: s.PublicPrefixes,
+		Authorizer:     s.Authorizer,
+		TokenLifetimes: s.TokenLifetimes,
+		publicKey:      s.publicKey,
+		privateKey:     s.privateKey,
+	}
+}
+
+// registry returns the configured service with the given name, or nil if there isn't one. Anything the service
+// doesn't configure itself is filled in from the top level configuration.
+func (s *Server) registry(service string) *Registry {
+	if service == s.Service {
+		return s.defaultRegistry()
+	}
+	configured, ok := s.Registries[service]
+	if !ok {
+		return nil
+	}
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+	registry := *configured
+	if registry.privateKey == nil {
+		registry.publicKey, registry.privateKey = s.publicKey, s.privateKey
+	}
+	if registry.TokenLifetimes == nil {
+		registry.TokenLifetimes = s.TokenLifetimes
+	}
+	return &registry
+}
+
+// authenticators returns the service's own authenticators followed by the top level ones
+func (s *Server) authenticators(registry *Registry) AuthenticatorChain {
+	return append(slices.Clone(registry.Authenticators), s.Authenticators...)
+}
+
+// publicKeys returns the keys tokens may have been signed with, including those in the certificate bundles, keyed by
+// their ID
+func (s *Server) publicKeys() map[string]libtrust.PublicKey {
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+	keys := map[string]libtrust.PublicKey{}
+	for _, key := range append([]libtrust.PublicKey{s.publicKey}, s.bundleKeys...) {
+		if key != nil {
+			keys[key.KeyID()] = key
+		}
+	}
+	for _, registry := range s.Registries {
+		for _, key := range append([]libtrust.PublicKey{registry.publicKey}, registry.bundleKeys...) {
+			if key != nil {
+				keys[key.KeyID()] = key
+			}
+		}
+	}
+	return keys
+}
+
+// rotateKeys moves the signing keys of the server, and of any services with their own, through the rotation schedule,
+// swapping in the keys of any that changed
+func (s *Server) rotateKeys(now time.Time) error {
+	changed, err := certs.RotateKeys(s.CertPath, s.KeyPath, *s.KeyRotation, now)
+	if err != nil {
+		return err
+	}
+	if changed {
+		err = s.LoadCertAndKey(s.CertPath, s.KeyPath)
+		if err != nil {
+			return err
+		}
+	}
+	for _, registry := range s.Registries {
+		if registry.CertPath == "" {
+			continue
+		}
+		changed, err = certs.RotateKeys(registry.CertPath, registry.KeyPath, *s.KeyRotation, now)
+		if err != nil {
+			return fmt.Errorf("%s: %w", registry.Service, err)
+		}
+		if !changed {
+			continue
+		}
+		pk, prk, bundle, err := loadSigningKeys(registry.Service, registry.CertPath, registry.KeyPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", registry.Service, err)
+		}
+		s.keyLock.Lock()
+		registry.publicKey, registry.privateKey, registry.bundleKeys = pk, prk, bundle
+		s.keyLock.Unlock()
+	}
+	return nil
+}
+
+// watchKeyRotation periodically rotates the signing keys, keeping the existing keys if rotation fails
+func (s *Server) watchKeyRotation(interval time.Duration) {
+	for range time.Tick(interval) {
+		err := s.rotateKeys(time.Now())
+		if err != nil {
+			log.Errorf("Unable to rotate signing keys: %s", err)
+		}
+	}
+}
+
+// registryFor returns the service a token has been requested for, a request without a service is for the default
+// service, and requests for unknown services are rejected unless they are configured to be rewritten
+func (s *Server) registryFor(service string) (*Registry, error) {
+	if service == "" {
+		return s.defaultRegistry(), nil
+	}
+	if registry := s.registry(service); registry != nil {
+		return registry, nil
+	}
+	if s.RewriteService {
+		log.Debugf("Rewriting unknown service %s to %s", service, s.Service)
+		return s.defaultRegistry(), nil
+	}
+	return nil, fmt.Errorf("unknown service: %s", service)
+}
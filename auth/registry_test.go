@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/docker/libtrust"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/greboid/registryauth/certs"
+)
+
+func TestParseRegistries(t *testing.T) {
+	build := func(publicPrefixes []string, acl ACL, policy Policy) Authorizer {
+		return NewAuthorizer(publicPrefixes, acl, policy, nil)
+	}
+	defaults := &Registry{Service: "service", Issuer: "issuer", TokenLifetimes: &TokenLifetimes{Default: TokenLifetime{Expiry: time.Minute, Skew: time.Second}}}
+	registries, err := ParseRegistries([]byte("staging:\n  issuer: staging-issuer\n  public: lib\n  users:\n    staging: hash\n  token-expiry: 1h\nproduction:\n"), defaults, build)
+	if err != nil {
+		t.Fatalf("ParseRegistries() error = %v", err)
+	}
+	if len(registries) != 2 {
+		t.Fatalf("ParseRegistries() = %v, want 2 registries", registries)
+	}
+	if registries["staging"].Issuer != "staging-issuer" || registries["production"].Issuer != "issuer" {
+		t.Errorf("ParseRegistries() issuers = %s, %s", registries["staging"].Issuer, registries["production"].Issuer)
+	}
+	if lifetime := registries["staging"].TokenLifetimes.Default; lifetime.Expiry != time.Hour || lifetime.Skew != time.Second {
+		t.Errorf("ParseRegistries() staging lifetime = %v", lifetime)
+	}
+	if registries["production"].TokenLifetimes != defaults.TokenLifetimes {
+		t.Errorf("ParseRegistries() production lifetimes = %v, want defaults", registries["production"].TokenLifetimes)
+	}
+	if len(registries["staging"].Authenticators) != 1 || len(registries["production"].Authenticators) != 0 {
+		t.Errorf("ParseRegistries() authenticators = %v, %v", registries["staging"].Authenticators, registries["production"].Authenticators)
+	}
+	if _, err = ParseRegistries([]byte("staging:\n  public: \"~(unclosed\"\n"), defaults, build); err == nil {
+		t.Errorf("ParseRegistries() expected error for invalid public pattern")
+	}
+	if _, err = ParseRegistries([]byte("service:\n  issuer: other-issuer\n"), defaults, build); err == nil {
+		t.Errorf("ParseRegistries() expected error for the default service")
+	}
+	if _, err = ParseRegistries([]byte("staging:\n  unknown: true\n"), defaults, build); err == nil {
+		t.Errorf("ParseRegistries() expected error for unknown field")
+	}
+	if _, err = ParseRegistries([]byte("staging:\n  token-expiry: -1m\n"), defaults, build); err == nil {
+		t.Errorf("ParseRegistries() expected error for invalid token expiry")
+	}
+}
+
+func TestServer_HandleAuthService(t *testing.T) {
+	server := newTestServer(t)
+	stagingKey, err := libtrust.GenerateRSA2048PrivateKey()
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	server.Registries = map[string]*Registry{
+		"staging": {
+			Service:        "staging",
+			Issuer:         "staging-issuer",
+			PublicPrefixes: []string{"staging-public"},
+			Authorizer:     NewAuthorizer([]string{"staging-public"}, nil, nil, nil),
+			Authenticators: AuthenticatorChain{NewStaticAuthenticator(map[string]string{"staging": testPasswordHash})},
+			TokenLifetimes: &TokenLifetimes{Default: TokenLifetime{Expiry: time.Hour}},
+			publicKey:      stagingKey.PublicKey(),
+			privateKey:     stagingKey,
+		},
+	}
+	tests := []struct {
+		name         string
+		service      string
+		user         string
+		scope        string
+		rewrite      bool
+		wantStatus   int
+		wantAudience string
+		wantIssuer   string
+		wantAccess   int
+		wantExpiry   int
+		wantKey      libtrust.PublicKey
+	}{
+		{name: "Default service", service: "service", scope: "repository:public/app:pull", wantStatus: http.StatusOK, wantAudience: "service", wantIssuer: "issuer", wantAccess: 1, wantExpiry: 120, wantKey: server.publicKey},
+		{name: "No service", scope: "repository:public/app:pull", wantStatus: http.StatusOK, wantAudience: "service", wantIssuer: "issuer", wantAccess: 1, wantExpiry: 120, wantKey: server.publicKey},
+		{name: "Additional service", service: "staging", scope: "repository:staging-public/app:pull", wantStatus: http.StatusOK, wantAudience: "staging", wantIssuer: "staging-issuer", wantAccess: 1, wantExpiry: 3600, wantKey: stagingKey.PublicKey()},
+		{name: "Additional service public prefixes", service: "staging", scope: "repository:public/app:pull", wantStatus: http.StatusOK, wantAudience: "staging", wantIssuer: "staging-issuer", wantAccess: 0, wantExpiry: 3600, wantKey: stagingKey.PublicKey()},
+		{name: "Service user", service: "staging", user: "staging", scope: "repository:private/app:push", wantStatus: http.StatusOK, wantAudience: "staging", wantIssuer: "staging-issuer", wantAccess: 1, wantExpiry: 3600, wantKey: stagingKey.PublicKey()},
+		{name: "Top level user on service", service: "staging", user: "test", scope: "repository:private/app:push", wantStatus: http.StatusOK, wantAudience: "staging", wantIssuer: "staging-issuer", wantAccess: 1, wantExpiry: 3600, wantKey: stagingKey.PublicKey()},
+		{name: "Service user on default service", service: "service", user: "staging", scope: "repository:private/app:push", wantStatus: http.StatusOK, wantAudience: "service", wantIssuer: "issuer", wantAccess: 0, wantExpiry: 120, wantKey: server.publicKey},
+		{name: "Unknown service", service: "other", scope: "repository:public/app:pull", wantStatus: http.StatusBadRequest},
+		{name: "Rewritten service", service: "other", scope: "repository:public/app:pull", rewrite: true, wantStatus: http.StatusOK, wantAudience: "service", wantIssuer: "issuer", wantAccess: 1, wantExpiry: 120, wantKey: server.publicKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.RewriteService = tt.rewrite
+			query := url.Values{"scope": {tt.scope}}
+			if tt.service != "" {
+				query.Set("service", tt.service)
+			}
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, "/auth?"+query.Encode(), nil)
+			if tt.user != "" {
+				request.SetBasicAuth(tt.user, "test")
+			}
+			server.HandleAuth(recorder, request)
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("HandleAuth() status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			response := &Response{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+				t.Fatalf("unable to parse response: %v", err)
+			}
+			if response.ExpiresIn != tt.wantExpiry {
+				t.Errorf("HandleAuth() expires_in = %d, want %d", response.ExpiresIn, tt.wantExpiry)
+			}
+			parsed, err := jwt.ParseSigned(response.Token, []jose.SignatureAlgorithm{jose.RS256})
+			if err != nil {
+				t.Fatalf("unable to parse token: %v", err)
+			}
+			if parsed.Headers[0].KeyID != tt.wantKey.KeyID() {
+				t.Errorf("HandleAuth() kid = %s, want %s", parsed.Headers[0].KeyID, tt.wantKey.KeyID())
+			}
+			claims, err := server.verifyToken(response.Token)
+			if err != nil {
+				t.Fatalf("verifyToken() error = %v", err)
+			}
+			if claims.Audience != tt.wantAudience || claims.Issuer != tt.wantIssuer || len(claims.Access) != tt.wantAccess {
+				t.Errorf("HandleAuth() aud = %s, iss = %s, access = %v", claims.Audience, claims.Issuer, actionsToString(claims.Access))
+			}
+		})
+	}
+}
+
+func TestServer_rotateKeys(t *testing.T) {
+	server := newTestServer(t)
+	server.CertPath, server.KeyPath = certs.CertPathsIn(t.TempDir())
+	server.KeyRotation = &certs.KeyRotation{Interval: 10 * time.Hour, Grace: 2 * time.Hour, Retire: 4 * time.Hour}
+	if err := certs.GenerateSelfSignedCert(server.CertPath, server.KeyPath); err != nil {
+		t.Fatalf("GenerateSelfSignedCert() error = %v", err)
+	}
+	if err := server.LoadCertAndKey(server.CertPath, server.KeyPath); err != nil {
+		t.Fatalf("LoadCertAndKey() error = %v", err)
+	}
+	rotate := func(now time.Time, wantBundle int) {
+		t.Helper()
+		if err := server.rotateKeys(now); err != nil {
+			t.Fatalf("rotateKeys() error = %v", err)
+		}
+		bundle, err := certs.ReadBundle(certs.BundlePath(server.CertPath))
+		if err != nil {
+			t.Fatalf("ReadBundle() error = %v", err)
+		}
+		if len(bundle) != wantBundle || len(server.publicKeys()) != wantBundle {
+			t.Fatalf("rotateKeys() bundle = %d certificates, %d public keys, want %d", len(bundle), len(server.publicKeys()), wantBundle)
+		}
+	}
+	rotate(time.Now(), 1)
+	oldKey := server.publicKey.KeyID()
+	accessToken, err := server.GetFullAccessToken()
+	if err != nil {
+		t.Fatalf("GetFullAccessToken() error = %v", err)
+	}
+
+	rotate(time.Now().Add(8*time.Hour), 2)
+	if server.publicKey.KeyID() != oldKey {
+		t.Errorf("rotateKeys() replaced the signing key before the grace period")
+	}
+	bundle, _ := certs.ReadBundle(certs.BundlePath(server.CertPath))
+	next := bundle[1].NotBefore
+
+	rotate(next.Add(2*time.Hour), 2)
+	if server.publicKey.KeyID() == oldKey {
+		t.Errorf("rotateKeys() did not promote the next signing key after the grace period")
+	}
+	if _, err = server.verifyToken(accessToken); err != nil {
+		t.Errorf("token signed with the previous key not verified: %v", err)
+	}
+
+	rotate(next.Add(6*time.Hour), 1)
+	if _, err = server.verifyToken(accessToken); err == nil {
+		t.Errorf("token signed with a retired key verified")
+	}
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	RevocationFile = flag.String("revocations", "", "File to persist token revocations to, by default this will be [DATA_DIR]/revocations.json")
+)
+
+// RevocationList records revoked token IDs and subjects whose tokens issued up to a point in time are revoked, it is
+// persisted to disk on every change so revocations survive a restart
+type RevocationList struct {
+	path      string
+	retention time.Duration
+	lock      sync.RWMutex
+	JTIs      map[string]time.Time `json:"jtis"`
+	Subjects  map[string]time.Time `json:"subjects"`
+}
+
+// NewRevocationList loads any existing revocations from path, revoked token IDs are forgotten once retention has
+// passed as any token they refer to will have expired
+func NewRevocationList(path string, retention time.Duration) (*RevocationList, error) {
+	list := &RevocationList{
+		path:      path,
+		retention: retention,
+		JTIs:      map[string]time.Time{},
+		Subjects:  map[string]time.Time{},
+	}
+	if path == "" {
+		return list, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return list, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, list)
+	if err != nil {
+		return nil, err
+	}
+	if list.JTIs == nil {
+		list.JTIs = map[string]time.Time{}
+	}
+	if list.Subjects == nil {
+		list.Subjects = map[string]time.Time{}
+	}
+	log.Infof("Loaded %d revoked tokens and %d revoked subjects", len(list.JTIs), len(list.Subjects))
+	return list, nil
+}
+
+// RevokeJTI revokes a single token
+func (r *RevocationList) RevokeJTI(jti string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.JTIs[jti] = time.Now()
+	log.Infof("Revoked token: %s", jti)
+	return r.save()
+}
+
+// RevokeSubject revokes all tokens for the subject issued at or before the given time
+func (r *RevocationList) RevokeSubject(subject string, before time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if existing, ok := r.Subjects[subject]; !ok || before.After(existing) {
+		r.Subjects[subject] = before
+	}
+	log.Infof("Revoked tokens for %s issued before %s", subject, before.Format(time.RFC3339))
+	return r.save()
+}
+
+// IsRevoked checks whether a token has been revoked either directly or via its subject
+func (r *RevocationList) IsRevoked(jti string, subject string, issuedAt time.Time) bool {
+	if r == nil {
+		return false
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if _, ok := r.JTIs[jti]; ok && jti != "" {
+		return true
+	}
+	if before, ok := r.Subjects[subject]; ok && !issuedAt.After(before) {
+		return true
+	}
+	return false
+}
+
+func (r *RevocationList) save() error {
+	if r.retention > 0 {
+		for jti, revoked := range r.JTIs {
+			if time.Since(revoked) > r.retention {
+				delete(r.JTIs, jti)
+			}
+		}
+	}
+	if r.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(r.path), 0711)
+	if err != nil {
+		return err
+	}
+	tempPath := r.path + ".tmp"
+	err = os.WriteFile(tempPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, r.path)
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRevocationList_IsRevoked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	list, err := NewRevocationList(path, time.Hour)
+	if err != nil {
+		t.Fatalf("NewRevocationList() error = %v", err)
+	}
+	revokedAt := time.Unix(1700000000, 0)
+	if err = list.RevokeJTI("revoked-jti"); err != nil {
+		t.Fatalf("RevokeJTI() error = %v", err)
+	}
+	if err = list.RevokeSubject("revoked-user", revokedAt); err != nil {
+		t.Fatalf("RevokeSubject() error = %v", err)
+	}
+	loaded, err := NewRevocationList(path, time.Hour)
+	if err != nil {
+		t.Fatalf("NewRevocationList() error = %v", err)
+	}
+	tests := []struct {
+		name     string
+		jti      string
+		subject  string
+		issuedAt time.Time
+		want     bool
+	}{
+		{name: "Not revoked", jti: "other", subject: "user", issuedAt: revokedAt, want: false},
+		{name: "Revoked jti", jti: "revoked-jti", subject: "user", issuedAt: revokedAt, want: true},
+		{name: "Revoked subject before", jti: "other", subject: "revoked-user", issuedAt: revokedAt.Add(-time.Hour), want: true},
+		{name: "Revoked subject at", jti: "other", subject: "revoked-user", issuedAt: revokedAt, want: true},
+		{name: "Revoked subject after", jti: "other", subject: "revoked-user", issuedAt: revokedAt.Add(time.Second), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := loaded.IsRevoked(tt.jti, tt.subject, tt.issuedAt); got != tt.want {
+				t.Errorf("IsRevoked() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_AdminRevoke(t *testing.T) {
+	server := newTestServer(t)
+	server.Router = mux.NewRouter()
+	server.AdminGroup = "admin"
+	server.Authenticators = AuthenticatorChain{NewStaticAuthenticator(map[string]string{"test": testPasswordHash, "user": testPasswordHash, "wildcard": testPasswordHash})}
+	server.Groups = map[string][]string{"admin": {"test"}, "*": {"wildcard"}}
+	server.Revocations, _ = NewRevocationList("", time.Hour)
+	server.addAdminRoutes()
+
+	authRequest := &Request{User: "user", Service: "service"}
+	accessToken, err := authRequest.getResponseToken(server.publicKey, server.privateKey, server.Issuer, TokenLifetime{Expiry: time.Minute}, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("unable to create token: %v", err)
+	}
+	validate := func() int {
+		request := httptest.NewRequest(http.MethodGet, "/validate?service=service", nil)
+		request.Header.Set("Authorization", "Bearer "+accessToken)
+		recorder := httptest.NewRecorder()
+		server.Router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	if code := validate(); code != http.StatusOK {
+		t.Fatalf("validate before revocation = %d, want %d", code, http.StatusOK)
+	}
+
+	revoke := func(user string, password string) int {
+		request := httptest.NewRequest(http.MethodPost, "/admin/revoke", strings.NewReader(`{"subject":"user"}`))
+		request.SetBasicAuth(user, password)
+		recorder := httptest.NewRecorder()
+		server.Router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	if code := revoke("user", "test"); code != http.StatusForbidden {
+		t.Errorf("revoke as non admin = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := revoke("wildcard", "test"); code != http.StatusForbidden {
+		t.Errorf("revoke as member of * group = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := revoke("test", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("revoke with wrong password = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := revoke("test", "test"); code != http.StatusNoContent {
+		t.Fatalf("revoke as admin = %d, want %d", code, http.StatusNoContent)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/validate", nil)
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	recorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("validate after revocation = %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+	response := &ValidateResponse{}
+	if err = json.Unmarshal(recorder.Body.Bytes(), response); err != nil || response.Active {
+		t.Errorf("validate after revocation = %s", recorder.Body.String())
+	}
+}
@@ -4,16 +4,19 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/libtrust"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/greboid/registryauth/certs"
+	"github.com/greboid/registryauth/metrics"
 	"gopkg.in/yaml.v2"
 )
 
@@ -22,10 +25,26 @@ var (
 )
 
 type Server struct {
+	keyLock        sync.RWMutex
 	publicKey      libtrust.PublicKey
 	privateKey     libtrust.PrivateKey
-	Users          map[string]string
+	bundleKeys     []libtrust.PublicKey
+	KeyRotation    *certs.KeyRotation
+	Authenticators AuthenticatorChain
+	Groups         map[string][]string
 	PublicPrefixes []string
+	Authorizer     Authorizer
+	Registries     map[string]*Registry
+	RewriteService bool
+	TokenLifetimes *TokenLifetimes
+	RefreshExpiry  time.Duration
+	Revocations    *RevocationList
+	Lockouts       *LockoutTracker
+	RateLimits     *RateLimiter
+	Audit          *AuditLog
+	ReadyChecks    map[string]ReadyCheck
+	TrustedProxies []*net.IPNet
+	AdminGroup     string
 	Issuer         string
 	CertDir        string
 	CertPath       string
@@ -46,7 +65,26 @@ func (s *Server) Initialise() error {
 	if err != nil {
 		return fmt.Errorf("loading certicates: %s", err.Error())
 	}
+	for _, registry := range s.Registries {
+		err = registry.loadKeys()
+		if err != nil {
+			return err
+		}
+	}
+	if s.KeyRotation != nil {
+		err = s.rotateKeys(time.Now())
+		if err != nil {
+			return fmt.Errorf("rotating keys: %s", err.Error())
+		}
+		go s.watchKeyRotation(time.Minute)
+	}
 	s.Router.PathPrefix("/auth").HandlerFunc(s.HandleAuth).Methods(http.MethodPost, http.MethodGet)
+	s.Router.Path("/.well-known/jwks.json").HandlerFunc(s.HandleJWKS).Methods(http.MethodGet)
+	s.addHealthRoutes()
+	if *metrics.Enabled {
+		s.Router.Path("/metrics").Handler(metrics.Handler())
+	}
+	s.addAdminRoutes()
 	return nil
 }
 
@@ -70,12 +108,28 @@ func (s *Server) StartAndWait() error {
 	return nil
 }
 
-func ParsePrefixes(prefixInput string) []string {
+func ParsePrefixes(prefixInput string) ([]string, error) {
 	var prefixList []string
 	for _, prefix := range strings.Split(prefixInput, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix != "" {
+			_, err := compilePublicPattern(prefix)
+			if err != nil {
+				return nil, fmt.Errorf("invalid public pattern %s: %w", prefix, err)
+			}
+		}
 		prefixList = append(prefixList, prefix)
 	}
-	return prefixList
+	return prefixList, nil
+}
+
+func ParseGroups(groupInput string) (map[string][]string, error) {
+	groupList := map[string][]string{}
+	err := yaml.Unmarshal([]byte(groupInput), groupList)
+	if err != nil {
+		return nil, err
+	}
+	return groupList, nil
 }
 
 func ParseUsers(userInput string) (map[string]string, error) {
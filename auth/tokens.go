@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth/token"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	TokenFile = flag.String("tokens", "", "Path to a yaml file of personal access tokens")
+)
+
+// APIToken is a named secret bound to a user that can be used in place of their password, optionally restricted to
+// a subset of repositories and actions
+type APIToken struct {
+	Name         string    `yaml:"name"`
+	User         string    `yaml:"user"`
+	Secret       string    `yaml:"secret"`
+	Repositories []string  `yaml:"repositories"`
+	Actions      []string  `yaml:"actions"`
+	Expires      time.Time `yaml:"expires"`
+	Revoked      bool      `yaml:"revoked"`
+	patterns     []*regexp.Regexp
+}
+
+// TokenStore holds the tokens from a file, re-reading it whenever it is modified so tokens can be added, rotated and
+// revoked without a restart
+type TokenStore struct {
+	path     string
+	lock     sync.RWMutex
+	modified time.Time
+	tokens   []*APIToken
+}
+
+func NewTokenStore(path string) (*TokenStore, error) {
+	if path == "" {
+		return nil, nil
+	}
+	store := &TokenStore{path: path}
+	err := store.reload()
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func ParseTokens(input []byte) ([]*APIToken, error) {
+	var tokens []*APIToken
+	err := yaml.UnmarshalStrict(input, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for index, apiToken := range tokens {
+		if apiToken.Name == "" || apiToken.User == "" || apiToken.Secret == "" {
+			return nil, fmt.Errorf("token %d must have a name, user and secret", index+1)
+		}
+		if names[apiToken.Name] {
+			return nil, fmt.Errorf("duplicate token name: %s", apiToken.Name)
+		}
+		names[apiToken.Name] = true
+		for _, repository := range apiToken.Repositories {
+			pattern, err := compilePattern(repository)
+			if err != nil {
+				return nil, fmt.Errorf("token %s: %w", apiToken.Name, err)
+			}
+			apiToken.patterns = append(apiToken.patterns, pattern)
+		}
+	}
+	return tokens, nil
+}
+
+func (t *TokenStore) reload() error {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	t.lock.RLock()
+	unchanged := info.ModTime().Equal(t.modified)
+	t.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	tokens, err := ParseTokens(data)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.tokens = tokens
+	t.modified = info.ModTime()
+	log.Infof("Loaded %d tokens", len(tokens))
+	return nil
+}
+
+func (t *TokenStore) current() []*APIToken {
+	if err := t.reload(); err != nil {
+		log.Errorf("Unable to reload tokens, using previous tokens: %s", err)
+	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.tokens
+}
+
+// Authenticate returns an identity carrying the usable token for the user with the given secret, or nil if there
+// isn't one
+func (t *TokenStore) Authenticate(user string, secret string) (*Identity, error) {
+	if t == nil || user == "" || secret == "" {
+		return nil, nil
+	}
+	for _, apiToken := range t.current() {
+		if apiToken.User != user || apiToken.usable() != nil {
+			continue
+		}
+		if checkPassword(apiToken.Secret, secret) {
+			log.Debugf("Authenticated user %s with token %s", user, apiToken.Name)
+			return &Identity{User: user, Token: apiToken}, nil
+		}
+	}
+	return nil, nil
+}
+
+// Refresh checks the token a refresh token was issued to is still usable and bound to the user
+func (t *TokenStore) Refresh(user string, tokenName string) (*Identity, error) {
+	if tokenName == "" {
+		return nil, nil
+	}
+	apiToken, err := t.Get(tokenName)
+	if err != nil {
+		return nil, err
+	}
+	if apiToken.User != user {
+		return nil, fmt.Errorf("token %s is not bound to %s", tokenName, user)
+	}
+	return &Identity{User: user, Token: apiToken}, nil
+}
+
+// Get returns the named token if it is still usable
+func (t *TokenStore) Get(name string) (*APIToken, error) {
+	if t == nil {
+		return nil, errors.New("no token store")
+	}
+	for _, apiToken := range t.current() {
+		if apiToken.Name == name {
+			return apiToken, apiToken.usable()
+		}
+	}
+	return nil, fmt.Errorf("unknown token: %s", name)
+}
+
+func (a *APIToken) usable() error {
+	if a.Revoked {
+		return fmt.Errorf("token %s is revoked", a.Name)
+	}
+	if !a.Expires.IsZero() && time.Now().After(a.Expires) {
+		return fmt.Errorf("token %s has expired", a.Name)
+	}
+	return nil
+}
+
+// restrict limits a scope to the repositories and actions the token allows, empty lists allow everything and public
+// scopes can always be pulled
+func (a *APIToken) restrict(scope *token.ResourceActions, isPublic bool) *token.ResourceActions {
+	allowed := append([]string{}, a.Actions...)
+	if len(allowed) == 0 {
+		allowed = []string{"*"}
+	}
+	if len(a.patterns) > 0 && !matchesAnyPattern(a.patterns, scope.Name) {
+		allowed = nil
+	}
+	if isPublic {
+		allowed = append(allowed, "pull")
+	}
+	actions := intersectActions(scope.Actions, allowed)
+	if len(actions) == 0 {
+		log.Debugf("Scope rejected (token %s) - Type: %s, Name: %s", a.Name, scope.Type, scope.Name)
+		return nil
+	}
+	return &token.ResourceActions{
+		Type:    scope.Type,
+		Class:   scope.Class,
+		Name:    scope.Name,
+		Actions: actions,
+	}
+}
+
+func matchesAnyPattern(patterns []*regexp.Regexp, name string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth/token"
+)
+
+const testTokens = `
+- name: pipeline
+  user: ci
+  secret: "` + testPasswordHash + `"
+  repositories: ["ci/**"]
+  actions: [pull, push]
+- name: expired
+  user: ci
+  secret: "` + testPasswordHash + `"
+  expires: 2000-01-01T00:00:00Z
+- name: revoked
+  user: other
+  secret: "` + testPasswordHash + `"
+  revoked: true
+`
+
+func writeTokens(t *testing.T, path string, content string) {
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("unable to write tokens: %v", err)
+	}
+}
+
+func TestTokenStore_Authenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.yml")
+	writeTokens(t, path, testTokens)
+	store, err := NewTokenStore(path)
+	if err != nil {
+		t.Fatalf("NewTokenStore() error = %v", err)
+	}
+	tests := []struct {
+		name     string
+		user     string
+		secret   string
+		wantName string
+	}{
+		{name: "Valid token", user: "ci", secret: "test", wantName: "pipeline"},
+		{name: "Wrong secret", user: "ci", secret: "wrong"},
+		{name: "Wrong user", user: "someone", secret: "test"},
+		{name: "Revoked", user: "other", secret: "test"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := store.Authenticate(tt.user, tt.secret)
+			if (got == nil && tt.wantName != "") || (got != nil && got.Token.Name != tt.wantName) {
+				t.Errorf("Authenticate() = %v, want %s", got, tt.wantName)
+			}
+		})
+	}
+	if _, err := store.Get("expired"); err == nil {
+		t.Errorf("Get() expected error for expired token")
+	}
+
+	writeTokens(t, path, "- name: pipeline\n  user: ci\n  secret: \""+testPasswordHash+"\"\n  revoked: true\n")
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatalf("unable to update modification time: %v", err)
+	}
+	if got, _ := store.Authenticate("ci", "test"); got != nil {
+		t.Errorf("Authenticate() after revocation = %v, want nil", got)
+	}
+}
+
+func TestParseTokens_Invalid(t *testing.T) {
+	if _, err := ParseTokens([]byte("- name: test\n  user: test\n")); err == nil {
+		t.Errorf("ParseTokens() expected error for missing secret")
+	}
+	if _, err := ParseTokens([]byte("- {name: a, user: b, secret: c}\n- {name: a, user: b, secret: c}\n")); err == nil {
+		t.Errorf("ParseTokens() expected error for duplicate names")
+	}
+}
+
+func TestServer_AuthorizeToken(t *testing.T) {
+	tokens, err := ParseTokens([]byte(testTokens))
+	if err != nil {
+		t.Fatalf("ParseTokens() error = %v", err)
+	}
+	request := &Request{
+		User: "ci",
+		RequestedScope: []*token.ResourceActions{
+			{Type: "repository", Name: "ci/app", Actions: []string{"pull", "push", "delete"}},
+			{Type: "repository", Name: "prod/app", Actions: []string{"pull", "push"}},
+			{Type: "repository", Name: "public/app", Actions: []string{"pull", "push"}},
+		},
+		validCredentials: true,
+		apiToken:         tokens[0],
+	}
+	want := []*token.ResourceActions{
+		{Type: "repository", Name: "ci/app", Actions: []string{"pull", "push"}},
+		{Type: "repository", Name: "public/app", Actions: []string{"pull"}},
+	}
+	got, err := authorise(NewAuthorizer([]string{"public"}, nil, nil, nil), []string{"public"}, request)
+	if err != nil {
+		t.Fatalf("authorise() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("authorise() = %v, want %v", actionsToString(got), actionsToString(want))
+	}
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	UserFile           = flag.String("users-file", "", "Path to a yaml file of users, in the same format as -users")
+	HtpasswdFile       = flag.String("htpasswd", "", "Path to an htpasswd file of users, only bcrypt entries are supported")
+	UserReloadInterval = flag.Duration("user-reload-interval", 10*time.Second, "How often the user files are checked for changes")
+)
+
+// UserFiles loads users from a yaml file and/or an htpasswd file, users in the files are added to the static users,
+// with the htpasswd file taking precedence
+type UserFiles struct {
+	Static   map[string]string
+	YAML     string
+	Htpasswd string
+	modified map[string]time.Time
+}
+
+func (u *UserFiles) paths() []string {
+	var paths []string
+	for _, path := range []string{u.YAML, u.Htpasswd} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// Changed reports whether any of the files have been modified since they were last loaded
+func (u *UserFiles) Changed() bool {
+	for _, path := range u.paths() {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Equal(u.modified[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Load reads the files and returns the combined users
+func (u *UserFiles) Load() (map[string]string, error) {
+	users := map[string]string{}
+	for user, hash := range u.Static {
+		users[user] = hash
+	}
+	modified := map[string]time.Time{}
+	if u.YAML != "" {
+		data, info, err := readWithInfo(u.YAML)
+		if err != nil {
+			return nil, err
+		}
+		fileUsers, err := ParseUsers(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", u.YAML, err)
+		}
+		for user, hash := range fileUsers {
+			users[user] = hash
+		}
+		modified[u.YAML] = info.ModTime()
+	}
+	if u.Htpasswd != "" {
+		data, info, err := readWithInfo(u.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		fileUsers, err := ParseHtpasswd(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", u.Htpasswd, err)
+		}
+		for user, hash := range fileUsers {
+			users[user] = hash
+		}
+		modified[u.Htpasswd] = info.ModTime()
+	}
+	u.modified = modified
+	return users, nil
+}
+
+func readWithInfo(path string) ([]byte, os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, info, nil
+}
+
+// ParseHtpasswd parses an Apache htpasswd file, entries not using bcrypt are skipped
+func ParseHtpasswd(input []byte) (map[string]string, error) {
+	users := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(input))
+	line := 0
+	for scanner.Scan() {
+		line++
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(entry, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("invalid entry on line %d", line)
+		}
+		if !strings.HasPrefix(hash, "$2a$") && !strings.HasPrefix(hash, "$2b$") && !strings.HasPrefix(hash, "$2y$") {
+			log.Warnf("Skipping htpasswd user %s, only bcrypt is supported", user)
+			continue
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseHtpasswd(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:  "Bcrypt entries",
+			input: "# comment\n\ntest:" + testPasswordHash + "\nother:$2y$05$abc\n",
+			want:  map[string]string{"test": testPasswordHash, "other": "$2y$05$abc"},
+		},
+		{
+			name:  "Skips other hashes",
+			input: "md5:$apr1$abc$def\nsha:{SHA}abc\ntest:" + testPasswordHash + "\n",
+			want:  map[string]string{"test": testPasswordHash},
+		},
+		{
+			name:    "Invalid entry",
+			input:   "test\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseHtpasswd([]byte(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseHtpasswd() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseHtpasswd() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaticAuthenticator_Watch(t *testing.T) {
+	directory := t.TempDir()
+	yamlPath := filepath.Join(directory, "users.yml")
+	htpasswdPath := filepath.Join(directory, "htpasswd")
+	if err := os.WriteFile(yamlPath, []byte("yaml: \""+testPasswordHash+"\"\n"), 0600); err != nil {
+		t.Fatalf("unable to write users: %v", err)
+	}
+	if err := os.WriteFile(htpasswdPath, []byte("htpasswd:"+testPasswordHash+"\n"), 0600); err != nil {
+		t.Fatalf("unable to write htpasswd: %v", err)
+	}
+	files := &UserFiles{
+		Static:   map[string]string{"static": testPasswordHash},
+		YAML:     yamlPath,
+		Htpasswd: htpasswdPath,
+	}
+	users, err := files.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(users) != 3 {
+		t.Fatalf("Load() = %v, want 3 users", users)
+	}
+	if files.Changed() {
+		t.Errorf("Changed() = true before modification")
+	}
+
+	authenticator := NewStaticAuthenticator(users)
+	authenticator.Watch(files, 10*time.Millisecond)
+	if err = os.WriteFile(htpasswdPath, []byte("added:"+testPasswordHash+"\n"), 0600); err != nil {
+		t.Fatalf("unable to write htpasswd: %v", err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err = os.Chtimes(htpasswdPath, future, future); err != nil {
+		t.Fatalf("unable to update modification time: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if authenticator.userExists("added") == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = authenticator.userExists("added"); err != nil {
+		t.Fatalf("user not added after reload: %v", err)
+	}
+	if err = authenticator.userExists("htpasswd"); err == nil {
+		t.Errorf("removed user still present after reload")
+	}
+	if err = authenticator.userExists("static"); err != nil {
+		t.Errorf("static user missing after reload: %v", err)
+	}
+	if err = authenticator.Ready(); err != nil {
+		t.Errorf("Ready() after reload = %v, want nil", err)
+	}
+
+	if err = os.WriteFile(yamlPath, []byte("invalid: [\n"), 0600); err != nil {
+		t.Fatalf("unable to write users: %v", err)
+	}
+	future = future.Add(time.Minute)
+	if err = os.Chtimes(yamlPath, future, future); err != nil {
+		t.Fatalf("unable to update modification time: %v", err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && authenticator.Ready() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = authenticator.Ready(); err == nil {
+		t.Errorf("Ready() after failed reload = nil, want error")
+	}
+	if err = authenticator.userExists("added"); err != nil {
+		t.Errorf("existing users not kept after failed reload: %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth/token"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	AuthWebhookURL       = flag.String("auth-webhook-url", "", "URL that usernames and passwords are POSTed to as JSON for verification by an external service")
+	AuthWebhookTimeout   = flag.Duration("auth-webhook-timeout", 5*time.Second, "How long to wait for the authentication webhook to respond")
+	AuthzWebhookURL      = flag.String("authz-webhook-url", "", "URL that the user and the scopes allowed by the other rules are POSTed to as JSON for approval by an external service, which can only narrow them")
+	AuthzWebhookTimeout  = flag.Duration("authz-webhook-timeout", 5*time.Second, "How long to wait for the authorization webhook to respond")
+	AuthzWebhookCache    = flag.Duration("authz-webhook-cache", time.Minute, "How long authorization webhook decisions are cached for, 0 disables caching")
+	AuthzWebhookFailOpen = flag.Bool("authz-webhook-fail-open", false, "Allow requested scopes if the authorization webhook fails, rather than denying them")
+)
+
+// WebhookAuthenticator asks an external HTTP service to verify credentials. The service responds 200 with the user's
+// groups to accept them, or 401, 403 or 404 to reject them, any other response is treated as an error. Users
+// authenticated by the webhook can't be looked up again later so they are never issued refresh tokens.
+type WebhookAuthenticator struct {
+	URL    string
+	client *http.Client
+}
+
+type webhookAuthRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type webhookAuthResponse struct {
+	Groups []string `json:"groups"`
+}
+
+func NewWebhookAuthenticator(url string, timeout time.Duration) *WebhookAuthenticator {
+	if url == "" {
+		return nil
+	}
+	return &WebhookAuthenticator{
+		URL:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (w *WebhookAuthenticator) Authenticate(user string, password string) (*Identity, error) {
+	if user == "" || password == "" {
+		return nil, nil
+	}
+	body, err := json.Marshal(&webhookAuthRequest{Username: user, Password: password})
+	if err != nil {
+		return nil, err
+	}
+	response, err := w.client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("bad response code: %d", response.StatusCode)
+	}
+	decoded := &webhookAuthResponse{}
+	err = json.NewDecoder(response.Body).Decode(decoded)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(decoded.Groups)
+	return &Identity{User: user, Groups: decoded.Groups}, nil
+}
+
+// WebhookAuthorizer defers to an external HTTP service, which is sent the user and the scopes approved so far and
+// responds with the scopes it approves. It can only remove access, any actions it returns that weren't sent are
+// ignored. Decisions are cached for the cache duration, and if the service fails the scopes are either passed through
+// unchanged (fail open) or the request is denied.
+type WebhookAuthorizer struct {
+	URL      string
+	Cache    time.Duration
+	FailOpen bool
+	client   *http.Client
+	lock     sync.Mutex
+	cached   map[string]*webhookDecision
+}
+
+type webhookAuthzRequest struct {
+	User          string                   `json:"user"`
+	Groups        []string                 `json:"groups"`
+	Authenticated bool                     `json:"authenticated"`
+	Service       string                   `json:"service"`
+	ClientID      string                   `json:"client_id"`
+	Scopes        []*token.ResourceActions `json:"scopes"`
+}
+
+type webhookAuthzResponse struct {
+	Scopes []*token.ResourceActions `json:"scopes"`
+}
+
+type webhookDecision struct {
+	scopes  []*token.ResourceActions
+	expires time.Time
+}
+
+// webhookCacheLimit caps the cached decisions, once it is reached new decisions are only cached if some have expired
+const webhookCacheLimit = 1000
+
+func NewWebhookAuthorizer(url string, timeout time.Duration, cache time.Duration, failOpen bool) *WebhookAuthorizer {
+	if url == "" {
+		return nil
+	}
+	return &WebhookAuthorizer{
+		URL:      url,
+		Cache:    cache,
+		FailOpen: failOpen,
+		client:   &http.Client{Timeout: timeout},
+		cached:   map[string]*webhookDecision{},
+	}
+}
+
+func (w *WebhookAuthorizer) Authorize(request *Request, scopes []*token.ResourceActions) ([]*token.ResourceActions, error) {
+	body, err := json.Marshal(&webhookAuthzRequest{
+		User:          request.User,
+		Groups:        request.Groups,
+		Authenticated: request.validCredentials,
+		Service:       request.Service,
+		ClientID:      request.ClientID,
+		Scopes:        scopes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	approved, ok := w.cachedDecision(string(body))
+	if !ok {
+		approved, err = w.post(body)
+		if err != nil {
+			if w.FailOpen {
+				log.Warnf("Authorization webhook failed, allowing scopes: %s", err)
+				return scopes, nil
+			}
+			return nil, fmt.Errorf("authorization webhook failed: %w", err)
+		}
+		w.storeDecision(string(body), approved)
+	}
+	return filterScopes(scopes, func(scope *token.ResourceActions) *token.ResourceActions {
+		var allowed []string
+		for _, approvedScope := range approved {
+			if approvedScope.Type == scope.Type && approvedScope.Name == scope.Name && approvedScope.Class == scope.Class {
+				allowed = append(allowed, approvedScope.Actions...)
+			}
+		}
+		actions := intersectActions(scope.Actions, allowed)
+		if len(actions) == 0 {
+			log.Debugf("Scope rejected (webhook) - User: %s, Type: %s, Name: %s", request.User, scope.Type, scope.Name)
+			return nil
+		}
+		return &token.ResourceActions{
+			Type:    scope.Type,
+			Class:   scope.Class,
+			Name:    scope.Name,
+			Actions: actions,
+		}
+	}), nil
+}
+
+func (w *WebhookAuthorizer) post(body []byte) ([]*token.ResourceActions, error) {
+	response, err := w.client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad response code: %d", response.StatusCode)
+	}
+	decoded := &webhookAuthzResponse{}
+	err = json.NewDecoder(response.Body).Decode(decoded)
+	if err != nil {
+		return nil, err
+	}
+	return decoded.Scopes, nil
+}
+
+func (w *WebhookAuthorizer) cachedDecision(key string) ([]*token.ResourceActions, bool) {
+	if w.Cache <= 0 {
+		return nil, false
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	decision, ok := w.cached[key]
+	if !ok || time.Now().After(decision.expires) {
+		return nil, false
+	}
+	return decision.scopes, true
+}
+
+func (w *WebhookAuthorizer) storeDecision(key string, scopes []*token.ResourceActions) {
+	if w.Cache <= 0 {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	now := time.Now()
+	if len(w.cached) >= webhookCacheLimit {
+		for cachedKey, decision := range w.cached {
+			if now.After(decision.expires) {
+				delete(w.cached, cachedKey)
+			}
+		}
+	}
+	if len(w.cached) >= webhookCacheLimit {
+		return
+	}
+	w.cached[key] = &webhookDecision{scopes: scopes, expires: now.Add(w.Cache)}
+}
@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth/token"
+)
+
+func TestWebhookAuthenticator_Authenticate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		credentials := &webhookAuthRequest{}
+		if err := json.NewDecoder(request.Body).Decode(credentials); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch {
+		case credentials.Username == "error":
+			writer.WriteHeader(http.StatusInternalServerError)
+		case credentials.Username == "alice" && credentials.Password == "secret":
+			_ = json.NewEncoder(writer).Encode(&webhookAuthResponse{Groups: []string{"staff", "release"}})
+		default:
+			writer.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		want     *Identity
+		wantErr  bool
+	}{
+		{name: "Accepted", user: "alice", password: "secret", want: &Identity{User: "alice", Groups: []string{"release", "staff"}}},
+		{name: "Rejected", user: "alice", password: "wrong"},
+		{name: "Empty password", user: "alice", password: ""},
+		{name: "Server error", user: "error", password: "secret", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := NewWebhookAuthenticator(server.URL, time.Second)
+			got, err := authenticator.Authenticate(tt.user, tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Authenticate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookAuthorizer_Authorize(t *testing.T) {
+	var calls atomic.Int32
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls.Add(1)
+		if failing.Load() {
+			writer.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		authzRequest := &webhookAuthzRequest{}
+		if err := json.NewDecoder(request.Body).Decode(authzRequest); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		response := &webhookAuthzResponse{}
+		for _, scope := range authzRequest.Scopes {
+			if authzRequest.User == "alice" && scope.Name == "alice/app" {
+				response.Scopes = append(response.Scopes, &token.ResourceActions{Type: scope.Type, Name: scope.Name, Actions: []string{"pull", "push", "delete"}})
+			} else if scope.Name == "shared/app" {
+				response.Scopes = append(response.Scopes, &token.ResourceActions{Type: scope.Type, Name: scope.Name, Actions: []string{"pull"}})
+			}
+		}
+		_ = json.NewEncoder(writer).Encode(response)
+	}))
+	defer server.Close()
+	request := &Request{
+		User:             "alice",
+		Service:          "service",
+		RequestedScope:   parseScope("repository:alice/app:pull,push repository:shared/app:pull,push repository:bob/app:pull"),
+		validCredentials: true,
+	}
+	want := parseScope("repository:alice/app:pull,push repository:shared/app:pull")
+
+	authorizer := NewWebhookAuthorizer(server.URL, time.Second, time.Minute, false)
+	for range 2 {
+		got, err := authorizer.Authorize(request, request.RequestedScope)
+		if err != nil {
+			t.Fatalf("Authorize() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Authorize() = %v, want %v", actionsToString(got), actionsToString(want))
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("webhook called %d times, want 1 with caching", calls.Load())
+	}
+
+	failing.Store(true)
+	if _, err := NewWebhookAuthorizer(server.URL, time.Second, 0, false).Authorize(request, request.RequestedScope); err == nil {
+		t.Errorf("Authorize() expected error when failing closed")
+	}
+	got, err := NewWebhookAuthorizer(server.URL, time.Second, 0, true).Authorize(request, request.RequestedScope)
+	if err != nil || !reflect.DeepEqual(got, request.RequestedScope) {
+		t.Errorf("Authorize() failing open = %v, %v", actionsToString(got), err)
+	}
+}
+
+func TestWebhookAuthorizer_OnlyNarrows(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		authzRequest := &webhookAuthzRequest{}
+		if err := json.NewDecoder(request.Body).Decode(authzRequest); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		response := &webhookAuthzResponse{Scopes: parseScope("repository:alice/app:pull,push,delete repository:private/app:pull,push")}
+		_ = json.NewEncoder(writer).Encode(response)
+	}))
+	defer server.Close()
+	acl, err := ParseACL([]byte("- users: [alice]\n  repositories: [\"alice/**\"]\n  actions: [pull]\n"))
+	if err != nil {
+		t.Fatalf("ParseACL() error = %v", err)
+	}
+	authorizer := append(NewAuthorizer([]string{"public"}, acl, nil, nil), NewWebhookAuthorizer(server.URL, time.Second, 0, false))
+	tests := []struct {
+		name          string
+		user          string
+		authenticated bool
+		scope         string
+		want          string
+	}{
+		{name: "Limited to the ACL", user: "alice", authenticated: true, scope: "repository:alice/app:pull,push,delete", want: "repository:alice/app:pull"},
+		{name: "Not granted by the ACL", user: "alice", authenticated: true, scope: "repository:private/app:pull", want: ""},
+		{name: "Anonymous private pull", scope: "repository:private/app:pull", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := &Request{User: tt.user, Service: "service", RequestedScope: parseScope(tt.scope), validCredentials: tt.authenticated}
+			got, err := authorizer.Authorize(request, request.RequestedScope)
+			if err != nil {
+				t.Fatalf("Authorize() error = %v", err)
+			}
+			if formatScope(got) != tt.want {
+				t.Errorf("Authorize() = %s, want %s", formatScope(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_HandleAuthWebhookFailure(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusBadGateway)
+	}))
+	defer webhook.Close()
+	output := &bytes.Buffer{}
+	server := newTestServer(t)
+	server.Audit = &AuditLog{writer: output}
+	server.Authorizer = append(NewAuthorizer([]string{"public"}, nil, nil, nil), NewWebhookAuthorizer(webhook.URL, time.Second, 0, false))
+	requests := map[string]*http.Request{
+		"HandleAuth":  httptest.NewRequest(http.MethodGet, "/auth?service=service&scope=repository:public/app:pull", nil),
+		"HandleOAuth": httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader("grant_type=password&client_id=test-client&username=test&password=test&service=service&scope=repository:public/app:pull")),
+	}
+	requests["HandleOAuth"].Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for name, request := range requests {
+		t.Run(name, func(t *testing.T) {
+			output.Reset()
+			recorder := httptest.NewRecorder()
+			server.HandleAuth(recorder, request)
+			if recorder.Code != http.StatusServiceUnavailable {
+				t.Errorf("%s() status = %d, want %d", name, recorder.Code, http.StatusServiceUnavailable)
+			}
+			event := &AuditEvent{}
+			if err := json.Unmarshal(output.Bytes(), event); err != nil {
+				t.Fatalf("unable to parse audit event %q: %v", output.String(), err)
+			}
+			if event.Reason != auditError {
+				t.Errorf("audit reason = %s, want %s", event.Reason, auditError)
+			}
+		})
+	}
+}
+
+func TestWebhookAuthorizer_storeDecision(t *testing.T) {
+	authorizer := NewWebhookAuthorizer("http://localhost", time.Second, time.Minute, false)
+	for index := range webhookCacheLimit + 10 {
+		authorizer.storeDecision(strconv.Itoa(index), nil)
+	}
+	if len(authorizer.cached) != webhookCacheLimit {
+		t.Errorf("storeDecision() cached %d decisions, want %d", len(authorizer.cached), webhookCacheLimit)
+	}
+	for _, decision := range authorizer.cached {
+		decision.expires = time.Now().Add(-time.Second)
+	}
+	authorizer.storeDecision("new", nil)
+	if _, ok := authorizer.cachedDecision("new"); !ok || len(authorizer.cached) != 1 {
+		t.Errorf("storeDecision() did not prune expired decisions, cached %d", len(authorizer.cached))
+	}
+}
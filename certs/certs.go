@@ -26,7 +26,12 @@ func GetCertPaths(dataDirectory string) (string, string) {
 	if *CertDirectory == "" {
 		*CertDirectory = filepath.Join(dataDirectory, "certs")
 	}
-	return filepath.Join(*CertDirectory, "cert.pem"), filepath.Join(*CertDirectory, "key.pem")
+	return CertPathsIn(*CertDirectory)
+}
+
+// CertPathsIn returns the paths of the certificate and key in the given directory
+func CertPathsIn(certDirectory string) (string, string) {
+	return filepath.Join(certDirectory, "cert.pem"), filepath.Join(certDirectory, "key.pem")
 }
 
 func GenerateSelfSignedCert(certPath string, keyPath string) error {
@@ -0,0 +1,236 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	KeyRotationInterval = flag.Duration("key-rotation", 0, "How long each signing key is used for before being replaced, 0 disables key rotation")
+	KeyRotationGrace    = flag.Duration("key-rotation-grace", 7*24*time.Hour, "How long a new signing key is published in the certificate bundle before it is used")
+	KeyRotationRetire   = flag.Duration("key-rotation-retire", 30*24*time.Hour, "How long a replaced signing key is kept in the certificate bundle, this must be at least the refresh token expiry")
+)
+
+// KeyRotation schedules replacing the signing key. The next key is generated Grace before the current key has been
+// used for Interval, and is published in the bundle until it is promoted, each replaced key is then kept in the bundle
+// for Retire after it was replaced so that tokens it signed can still be verified. The schedule is worked out from the
+// certificates' not before times and the replaced certificates' names so it carries on across restarts.
+type KeyRotation struct {
+	Interval time.Duration
+	Grace    time.Duration
+	Retire   time.Duration
+}
+
+func NewKeyRotation(interval time.Duration, grace time.Duration, retire time.Duration) (*KeyRotation, error) {
+	if interval <= 0 {
+		return nil, nil
+	}
+	if grace < 0 || grace >= interval {
+		return nil, fmt.Errorf("key rotation grace must be less than the rotation interval")
+	}
+	if retire < 0 {
+		return nil, fmt.Errorf("key rotation retire must not be negative")
+	}
+	return &KeyRotation{Interval: interval, Grace: grace, Retire: retire}, nil
+}
+
+// BundlePath returns the path of the certificate bundle beside the certificate, which has the certificates of the
+// current, next and previous keys and should be given to the registry as its rootcertbundle
+func BundlePath(certPath string) string {
+	return filepath.Join(filepath.Dir(certPath), "bundle.pem")
+}
+
+func nextPaths(certPath string, keyPath string) (string, string) {
+	return filepath.Join(filepath.Dir(certPath), "next-cert.pem"), filepath.Join(filepath.Dir(keyPath), "next-key.pem")
+}
+
+// previousPath returns the path the certificate replaced at the given time is kept at until it is retired
+func previousPath(certPath string, replaced time.Time) string {
+	return filepath.Join(filepath.Dir(certPath), fmt.Sprintf("previous-%d-cert.pem", replaced.Unix()))
+}
+
+type previousCert struct {
+	path     string
+	replaced time.Time
+}
+
+// previousCerts returns the certificates that have been replaced but not yet retired, most recently replaced first
+func previousCerts(certPath string) ([]previousCert, error) {
+	paths, err := filepath.Glob(filepath.Join(filepath.Dir(certPath), "previous-*-cert.pem"))
+	if err != nil {
+		return nil, err
+	}
+	var previous []previousCert
+	for _, path := range paths {
+		var replaced int64
+		if _, err = fmt.Sscanf(filepath.Base(path), "previous-%d-cert.pem", &replaced); err != nil {
+			continue
+		}
+		previous = append(previous, previousCert{path: path, replaced: time.Unix(replaced, 0)})
+	}
+	slices.SortFunc(previous, func(a, b previousCert) int {
+		return b.replaced.Compare(a.replaced)
+	})
+	return previous, nil
+}
+
+// RotateKeys moves the key beside the certificate through the rotation schedule: generating the next key when it is
+// due, promoting it once the grace period has passed and removing each previous certificate once it is retired. The
+// bundle is rewritten whenever anything changes, and true is returned if the keys or bundle changed.
+func RotateKeys(certPath string, keyPath string, rotation KeyRotation, now time.Time) (bool, error) {
+	nextCertPath, nextKeyPath := nextPaths(certPath, keyPath)
+	changed := false
+	current, err := readCertificate(certPath)
+	if err != nil {
+		return false, err
+	}
+	next, err := readCertificate(nextCertPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	if next != nil && !now.Before(next.NotBefore.Add(rotation.Grace)) {
+		log.Infof("Promoting next signing key: %s", certPath)
+		if err = promote(certPath, keyPath, nextCertPath, nextKeyPath, now); err != nil {
+			return false, err
+		}
+		current, next, changed = next, nil, true
+	}
+	if next == nil && !now.Before(current.NotBefore.Add(rotation.Interval-rotation.Grace)) {
+		log.Infof("Generating next signing key: %s", nextCertPath)
+		if err = GenerateSelfSignedCert(nextCertPath, nextKeyPath); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	previous, err := previousCerts(certPath)
+	if err != nil {
+		return false, err
+	}
+	for _, certificate := range previous {
+		if now.Before(certificate.replaced.Add(rotation.Retire)) {
+			continue
+		}
+		log.Infof("Retiring previous signing key: %s", certificate.path)
+		if err = os.Remove(certificate.path); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	if _, err = os.Stat(BundlePath(certPath)); errors.Is(err, os.ErrNotExist) {
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, writeBundle(certPath, nextCertPath)
+}
+
+// promote replaces the current key with the next, keeping a copy of the current certificate until it is retired. The
+// key is replaced before the certificate and put back if the certificate can't be, so a matching pair is left in place.
+func promote(certPath string, keyPath string, nextCertPath string, nextKeyPath string, now time.Time) error {
+	previous := previousPath(certPath, now)
+	err := copyFile(certPath, previous, 0644)
+	if err != nil {
+		return err
+	}
+	backupKeyPath := keyPath + ".old"
+	err = copyFile(keyPath, backupKeyPath, 0600)
+	if err != nil {
+		return errors.Join(err, os.Remove(previous))
+	}
+	defer func() {
+		_ = os.Remove(backupKeyPath)
+	}()
+	err = os.Rename(nextKeyPath, keyPath)
+	if err != nil {
+		return errors.Join(err, os.Remove(previous))
+	}
+	err = os.Rename(nextCertPath, certPath)
+	if err != nil {
+		return errors.Join(err, os.Rename(keyPath, nextKeyPath), os.Rename(backupKeyPath, keyPath), os.Remove(previous))
+	}
+	return nil
+}
+
+// copyFile copies the file via a temporary file, so the destination is never partially written
+func copyFile(source string, destination string, mode os.FileMode) error {
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	temporary := destination + ".tmp"
+	err = os.WriteFile(temporary, data, mode)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temporary, destination)
+}
+
+// writeBundle writes the current, next and previous certificates, whichever exist, to the bundle
+func writeBundle(certPath string, nextCertPath string) error {
+	paths := []string{certPath, nextCertPath}
+	previous, err := previousCerts(certPath)
+	if err != nil {
+		return err
+	}
+	for _, certificate := range previous {
+		paths = append(paths, certificate.path)
+	}
+	bundle := new(bytes.Buffer)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		bundle.Write(data)
+	}
+	temporary := BundlePath(certPath) + ".tmp"
+	err = os.WriteFile(temporary, bundle.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temporary, BundlePath(certPath))
+}
+
+// ReadBundle returns the certificates in a PEM file
+func ReadBundle(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certificates []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	return certificates, nil
+}
+
+func readCertificate(path string) (*x509.Certificate, error) {
+	certificates, err := ReadBundle(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no certificate in %s", path)
+	}
+	return certificates[0], nil
+}
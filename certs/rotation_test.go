@@ -0,0 +1,151 @@
+package certs
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewKeyRotation(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		grace    time.Duration
+		retire   time.Duration
+		wantNil  bool
+		wantErr  bool
+	}{
+		{name: "Disabled", interval: 0, grace: time.Hour, retire: time.Hour, wantNil: true},
+		{name: "Valid", interval: 10 * time.Hour, grace: 2 * time.Hour, retire: 4 * time.Hour},
+		{name: "Retire longer than interval", interval: 10 * time.Hour, grace: 2 * time.Hour, retire: 30 * time.Hour},
+		{name: "Grace not less than interval", interval: 10 * time.Hour, grace: 10 * time.Hour, retire: time.Hour, wantNil: true, wantErr: true},
+		{name: "Negative retire", interval: 10 * time.Hour, grace: 2 * time.Hour, retire: -time.Hour, wantNil: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewKeyRotation(tt.interval, tt.grace, tt.retire)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewKeyRotation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (got == nil) != tt.wantNil {
+				t.Errorf("NewKeyRotation() = %v, want nil %v", got, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	certPath, keyPath := CertPathsIn(t.TempDir())
+	if err := GenerateSelfSignedCert(certPath, keyPath); err != nil {
+		t.Fatalf("GenerateSelfSignedCert() error = %v", err)
+	}
+	// Generated certificates are valid from the real time rather than the simulated one, so the next key is in its grace
+	// period until start plus Grace, and after the first promotion each step also generates the next key. The retire
+	// period is longer than the interval so several previous keys are kept at once.
+	rotation := KeyRotation{Interval: 10 * time.Hour, Grace: 2 * time.Hour, Retire: 30 * time.Hour}
+	start := time.Now()
+	original := readTestCertificate(t, certPath)
+	tests := []struct {
+		name         string
+		now          time.Time
+		wantChanged  bool
+		wantBundle   int
+		wantPrevious int
+		wantPromoted bool
+	}{
+		{name: "Bundle created", now: start, wantChanged: true, wantBundle: 1},
+		{name: "Nothing due", now: start.Add(time.Hour), wantBundle: 1},
+		{name: "Next key generated", now: start.Add(8 * time.Hour), wantChanged: true, wantBundle: 2},
+		{name: "Next key in grace period", now: start.Add(time.Hour), wantBundle: 2},
+		{name: "First promotion", now: start.Add(10 * time.Hour), wantChanged: true, wantBundle: 3, wantPrevious: 1, wantPromoted: true},
+		{name: "Second promotion keeps first previous", now: start.Add(20 * time.Hour), wantChanged: true, wantBundle: 4, wantPrevious: 2, wantPromoted: true},
+		{name: "First previous retired", now: start.Add(40 * time.Hour), wantChanged: true, wantBundle: 4, wantPrevious: 2, wantPromoted: true},
+		{name: "Earlier previous retired", now: start.Add(70 * time.Hour), wantChanged: true, wantBundle: 3, wantPrevious: 1, wantPromoted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := readTestCertificate(t, certPath)
+			changed, err := RotateKeys(certPath, keyPath, rotation, tt.now)
+			if err != nil {
+				t.Fatalf("RotateKeys() error = %v", err)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("RotateKeys() = %v, want %v", changed, tt.wantChanged)
+			}
+			bundle, err := ReadBundle(BundlePath(certPath))
+			if err != nil {
+				t.Fatalf("ReadBundle() error = %v", err)
+			}
+			if len(bundle) != tt.wantBundle {
+				t.Errorf("RotateKeys() bundle = %d certificates, want %d", len(bundle), tt.wantBundle)
+			}
+			current := readTestCertificate(t, certPath)
+			if !bundle[0].Equal(current) {
+				t.Errorf("RotateKeys() bundle does not start with the current certificate")
+			}
+			if promoted := !current.Equal(before); promoted != tt.wantPromoted {
+				t.Errorf("RotateKeys() promoted = %v, want %v", promoted, tt.wantPromoted)
+			}
+			if !checkValid(certPath, keyPath) {
+				t.Errorf("RotateKeys() left a certificate and key that don't match")
+			}
+			previous, err := previousCerts(certPath)
+			if err != nil {
+				t.Fatalf("previousCerts() error = %v", err)
+			}
+			if len(previous) != tt.wantPrevious {
+				t.Errorf("RotateKeys() previous = %d certificates, want %d", len(previous), tt.wantPrevious)
+			}
+		})
+	}
+	for _, certificate := range mustReadBundle(t, BundlePath(certPath)) {
+		if certificate.Equal(original) {
+			t.Errorf("RotateKeys() kept the original certificate after it was retired")
+		}
+	}
+}
+
+func TestRotateKeys_FailedPromotion(t *testing.T) {
+	certPath, keyPath := CertPathsIn(t.TempDir())
+	rotation := KeyRotation{Interval: 10 * time.Hour, Grace: 2 * time.Hour, Retire: 30 * time.Hour}
+	if err := GenerateSelfSignedCert(certPath, keyPath); err != nil {
+		t.Fatalf("GenerateSelfSignedCert() error = %v", err)
+	}
+	if _, err := RotateKeys(certPath, keyPath, rotation, time.Now().Add(8*time.Hour)); err != nil {
+		t.Fatalf("RotateKeys() error = %v", err)
+	}
+	original := readTestCertificate(t, certPath)
+	_, nextKeyPath := nextPaths(certPath, keyPath)
+	if err := os.Remove(nextKeyPath); err != nil {
+		t.Fatalf("unable to remove next key: %v", err)
+	}
+	if _, err := RotateKeys(certPath, keyPath, rotation, time.Now().Add(10*time.Hour)); err == nil {
+		t.Fatalf("RotateKeys() without the next key succeeded")
+	}
+	if !readTestCertificate(t, certPath).Equal(original) || !checkValid(certPath, keyPath) {
+		t.Errorf("RotateKeys() did not leave the original certificate and key in place")
+	}
+	if previous, _ := filepath.Glob(filepath.Join(filepath.Dir(certPath), "previous-*")); len(previous) != 0 {
+		t.Errorf("RotateKeys() left previous certificates %v", previous)
+	}
+}
+
+func readTestCertificate(t *testing.T, path string) *x509.Certificate {
+	t.Helper()
+	certificate, err := readCertificate(path)
+	if err != nil {
+		t.Fatalf("unable to read certificate: %v", err)
+	}
+	return certificate
+}
+
+func mustReadBundle(t *testing.T, path string) []*x509.Certificate {
+	t.Helper()
+	bundle, err := ReadBundle(path)
+	if err != nil {
+		t.Fatalf("ReadBundle() error = %v", err)
+	}
+	return bundle
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"flag"
+	"maps"
 	"path/filepath"
+	"slices"
 
 	"github.com/csmith/envflag"
 	"github.com/gorilla/mux"
@@ -26,14 +28,130 @@ func main() {
 	if err != nil {
 		log.Fatalf("Unable to parse users: %s", err)
 	}
+	userFiles := &auth.UserFiles{
+		Static:   users,
+		YAML:     *auth.UserFile,
+		Htpasswd: *auth.HtpasswdFile,
+	}
+	users, err = userFiles.Load()
+	if err != nil {
+		log.Fatalf("Unable to load users: %s", err)
+	}
+	groups, err := auth.ParseGroups(*auth.GroupInput)
+	if err != nil {
+		log.Fatalf("Unable to parse groups: %s", err)
+	}
+	ldapAuthenticator, err := auth.NewLDAPAuthenticator(*auth.LDAPURL, *auth.LDAPBindDN, *auth.LDAPBindPassword,
+		*auth.LDAPBaseDN, *auth.LDAPUserFilter, *auth.LDAPUserAttribute, *auth.LDAPGroupAttribute, *auth.LDAPGroupInput)
+	if err != nil {
+		log.Fatalf("Unable to configure ldap: %s", err)
+	}
+	oidcAuthenticator, err := auth.NewOIDCAuthenticator(*auth.OIDCIssuer, *auth.OIDCAudience, *auth.OIDCUsernameClaim, *auth.OIDCGroupsClaim)
+	if err != nil {
+		log.Fatalf("Unable to configure oidc: %s", err)
+	}
+	tokens, err := auth.NewTokenStore(*auth.TokenFile)
+	if err != nil {
+		log.Fatalf("Unable to load tokens: %s", err)
+	}
+	webhookAuthenticator := auth.NewWebhookAuthenticator(*auth.AuthWebhookURL, *auth.AuthWebhookTimeout)
+	staticAuthenticator := auth.NewStaticAuthenticator(users)
+	authenticators := auth.AuthenticatorChain{staticAuthenticator}
+	if ldapAuthenticator != nil {
+		authenticators = append(authenticators, ldapAuthenticator)
+	}
+	if oidcAuthenticator != nil {
+		authenticators = append(authenticators, oidcAuthenticator)
+	}
+	if tokens != nil {
+		authenticators = append(authenticators, tokens)
+	}
+	if webhookAuthenticator != nil {
+		authenticators = append(authenticators, webhookAuthenticator)
+	}
+	acl, err := auth.LoadACL(*auth.ACLFile)
+	if err != nil {
+		log.Fatalf("Unable to load acl: %s", err)
+	}
+	policy, err := auth.LoadPolicy(*auth.PolicyFile)
+	if err != nil {
+		log.Fatalf("Unable to load policy: %s", err)
+	}
+	deny, err := auth.LoadACL(*auth.DenyFile)
+	if err != nil {
+		log.Fatalf("Unable to load deny list: %s", err)
+	}
+	publicPrefixes, err := auth.ParsePrefixes(*auth.PublicPrefixes)
+	if err != nil {
+		log.Fatalf("Unable to parse public patterns: %s", err)
+	}
+	webhookAuthorizer := auth.NewWebhookAuthorizer(*auth.AuthzWebhookURL, *auth.AuthzWebhookTimeout,
+		*auth.AuthzWebhookCache, *auth.AuthzWebhookFailOpen)
+	buildAuthorizer := func(publicPrefixes []string, serviceACL auth.ACL, servicePolicy auth.Policy) auth.Authorizer {
+		if serviceACL == nil {
+			serviceACL = acl
+		}
+		if servicePolicy == nil {
+			servicePolicy = policy
+		}
+		authorizer := auth.NewAuthorizer(publicPrefixes, serviceACL, servicePolicy, deny)
+		if webhookAuthorizer != nil {
+			authorizer = append(authorizer, webhookAuthorizer)
+		}
+		return authorizer
+	}
+	lifetimes, err := auth.ParseTokenLifetimes(*auth.TokenExpiry, *auth.TokenSkew, *auth.TokenOverrides)
+	if err != nil {
+		log.Fatalf("Unable to parse token lifetimes: %s", err)
+	}
+	registries, err := auth.LoadRegistries(*auth.ServicesFile, &auth.Registry{Service: *auth.Service, Issuer: *auth.Issuer, TokenLifetimes: lifetimes}, buildAuthorizer)
+	if err != nil {
+		log.Fatalf("Unable to load services: %s", err)
+	}
+	if *auth.RevocationFile == "" {
+		*auth.RevocationFile = filepath.Join(*dataDirectory, "revocations.json")
+	}
+	revocations, err := auth.NewRevocationList(*auth.RevocationFile, *auth.RefreshTokenExpiry)
+	if err != nil {
+		log.Fatalf("Unable to load revocations: %s", err)
+	}
+	trustedProxies, err := auth.ParseTrustedProxies(*auth.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Unable to parse trusted proxies: %s", err)
+	}
+	auditLog, err := auth.NewAuditLog(*auth.AuditLogPath)
+	if err != nil {
+		log.Fatalf("Unable to open audit log: %s", err)
+	}
+	keyRotation, err := certs.NewKeyRotation(*certs.KeyRotationInterval, *certs.KeyRotationGrace, *certs.KeyRotationRetire)
+	if err != nil {
+		log.Fatalf("Unable to configure key rotation: %s", err)
+	}
+	if keyRotation != nil && keyRotation.Retire < *auth.RefreshTokenExpiry {
+		log.Fatalf("Key rotation retire (%s) must be at least the refresh token expiry (%s)", keyRotation.Retire, *auth.RefreshTokenExpiry)
+	}
 	authServer := &auth.Server{
-		Users:          users,
-		PublicPrefixes: auth.ParsePrefixes(*auth.PublicPrefixes),
+		Authenticators: authenticators,
+		Groups:         groups,
+		PublicPrefixes: publicPrefixes,
+		Authorizer:     buildAuthorizer(publicPrefixes, nil, nil),
+		Registries:     registries,
+		RewriteService: *auth.RewriteUnknownService,
+		TokenLifetimes: lifetimes,
+		RefreshExpiry:  *auth.RefreshTokenExpiry,
+		Revocations:    revocations,
+		Lockouts:       auth.NewLockoutTracker(*auth.LockoutThreshold, *auth.LockoutBackoff, *auth.LockoutMax, *auth.LockoutReset),
+		RateLimits:     auth.NewRateLimiter(*auth.RateLimitIP, *auth.RateLimitAnonymous, *auth.RateLimitUser),
+		TrustedProxies: trustedProxies,
+		Audit:          auditLog,
+		ReadyChecks:    map[string]auth.ReadyCheck{"users": staticAuthenticator.Ready},
+		AdminGroup:     *auth.AdminGroup,
 		Issuer:         *auth.Issuer,
 		Realm:          *auth.Realm,
 		Service:        *auth.Service,
 		CertPath:       certPath,
 		KeyPath:        keyPath,
+		KeyRotation:    keyRotation,
 		Port:           *auth.ServerPort,
 		Debug:          *auth.Debug,
 		Router:         mux.NewRouter(),
@@ -42,8 +160,19 @@ func main() {
 	if err != nil {
 		log.Fatalf("Unable to %s", err.Error())
 	}
+	staticAuthenticator.Watch(userFiles, *auth.UserReloadInterval)
 	lister := listing.NewLister(authServer.PublicPrefixes, authServer.GetFullAccessToken)
+	for _, service := range slices.Sorted(maps.Keys(registries)) {
+		if registries[service].RegistryHost == "" {
+			continue
+		}
+		lister.AddRegistry(service, registries[service].RegistryHost, registries[service].PublicPrefixes,
+			func(repository ...string) (string, error) {
+				return authServer.GetServiceAccessToken(service, repository...)
+			})
+	}
 	lister.Initialise(authServer.Router)
+	authServer.ReadyChecks["listing"] = lister.Ready
 	log.Infof("Server started")
 	err = authServer.StartAndWait()
 	if err != nil {
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -11,7 +14,16 @@ import (
 	"golang.org/x/term"
 )
 
+var (
+	generateToken = flag.Bool("token", false, "Generate a random API token secret rather than reading a password")
+)
+
 func main() {
+	flag.Parse()
+	if *generateToken {
+		printToken()
+		return
+	}
 	state, err := term.GetState(syscall.Stdin)
 	if err != nil {
 		log.Printf("Unable to get terminal state: %s", err)
@@ -37,3 +49,18 @@ func main() {
 	fmt.Println()
 	fmt.Printf("%s\n", bytePassword)
 }
+
+func printToken() {
+	secretBytes := make([]byte, 32)
+	_, err := rand.Read(secretBytes)
+	if err != nil {
+		log.Fatalf("Unable to generate token: %s", err)
+	}
+	secret := "rat_" + base64.RawURLEncoding.EncodeToString(secretBytes)
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), 7)
+	if err != nil {
+		log.Fatalf("Unable to generate token: %s", err)
+	}
+	fmt.Printf("Token: %s\n", secret)
+	fmt.Printf("Secret: %s\n", hash)
+}
@@ -3,12 +3,15 @@ package listing
 import (
 	"embed"
 	"flag"
+	"fmt"
 	"html/template"
+	"sync/atomic"
 	"time"
 
 	"github.com/distribution/distribution/v3/registry/auth/token"
 	"github.com/gorilla/mux"
 	"github.com/greboid/registryauth/auth"
+	"github.com/greboid/registryauth/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -18,17 +21,27 @@ var (
 	PullHostname    = flag.String("pull-hostname", "", "Hostname to show on listings and info page, will default to the request hostname")
 	RegistryHost    = flag.String("registry-host", "http://localhost:8080", "The URL of the registry being listed")
 	RefreshInterval = flag.Duration("refresh-interval", 60*time.Second, "The time between registry refreshes")
+	ReadyIntervals  = flag.Int("ready-intervals", 3, "Number of refresh intervals without a successful refresh before the listing is reported as not ready")
 )
 
 //go:embed templates
 var templates embed.FS
 
 type Lister struct {
-	templates      *template.Template
+	templates  *template.Template
+	Registries []*Registry
+}
+
+// Registry is a registry whose public repositories are listed, the name is shown as a heading when more than one
+// registry is listed
+type Registry struct {
+	Name           string
+	Host           string
 	TokenProvider  TokenProvider
 	PublicPrefixes []string
-	repositories   *RepositoryList
-	lastPoll       time.Time
+	Repositories   *RepositoryList
+	LastPolled     time.Time
+	lastRefreshed  atomic.Int64
 }
 
 type TokenProvider func(...string) (string, error)
@@ -49,9 +62,9 @@ type Tag struct {
 }
 
 type ListingIndex struct {
-	Title        string
-	Repositories *RepositoryList
-	LastPolled   time.Time
+	Title      string
+	Registries []*Registry
+	LastPolled time.Time
 }
 
 type Index struct {
@@ -59,36 +72,74 @@ type Index struct {
 }
 
 func NewLister(publicPrefixes []string, getFullToken func(repository ...string) (string, error)) *Lister {
-	lister := &Lister{
+	lister := &Lister{}
+	lister.AddRegistry("", *RegistryHost, publicPrefixes, getFullToken)
+	return lister
+}
+
+// AddRegistry lists the public repositories of another registry on the index page
+func (s *Lister) AddRegistry(name string, host string, publicPrefixes []string, getFullToken func(repository ...string) (string, error)) {
+	s.Registries = append(s.Registries, &Registry{
+		Name:           name,
+		Host:           host,
 		TokenProvider:  getFullToken,
 		PublicPrefixes: publicPrefixes,
-	}
-	return lister
+	})
 }
 
 func (s *Lister) Initialise(router *mux.Router) {
 	s.addRoutes(router)
 }
 
+// Ready returns an error if listings are enabled and any registry hasn't been refreshed successfully within the
+// ready intervals
+func (s *Lister) Ready() error {
+	if !*ShowListings {
+		return nil
+	}
+	for _, registry := range s.Registries {
+		if registry.lastRefreshed.Load() == 0 {
+			return fmt.Errorf("%s has not been refreshed", registry.Host)
+		}
+		lastRefreshed := time.Unix(0, registry.lastRefreshed.Load())
+		if time.Since(lastRefreshed) > time.Duration(*ReadyIntervals)*(*RefreshInterval) {
+			return fmt.Errorf("%s last refreshed at %s", registry.Host, lastRefreshed.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
 func (s *Lister) start() {
+	for _, registry := range s.Registries {
+		registry.start()
+	}
+}
+
+func (s *Registry) start() {
 	go func() {
-		log.Infof("Refreshing repositories")
-		s.repositories = s.getRepositories()
-		s.lastPoll = time.Now()
-		log.Infof("Repository list refreshed")
+		s.refresh()
 		for range time.Tick(*RefreshInterval) {
-			log.Infof("Refreshing repositories")
-			s.repositories = s.getRepositories()
-			s.lastPoll = time.Now()
-			log.Infof("Repository list refreshed")
+			s.refresh()
 		}
 	}()
 }
 
-func (s *Lister) getRepositories() *RepositoryList {
+func (s *Registry) refresh() {
+	log.Infof("Refreshing repositories: %s", s.Host)
+	s.Repositories = s.getRepositories()
+	s.LastPolled = time.Now()
+	if s.Repositories != nil {
+		s.lastRefreshed.Store(s.LastPolled.UnixNano())
+	}
+	log.Infof("Repository list refreshed: %s", s.Host)
+}
+
+func (s *Registry) getRepositories() *RepositoryList {
+	defer metrics.ObserveSince(metrics.ListingRefreshDuration.WithLabelValues(s.Host), time.Now())
 	publicRepositories, err := s.getPublicRepositories()
 	if err != nil {
 		log.Printf("Error: %s", err)
+		metrics.ListingRefreshFailures.WithLabelValues(s.Host).Inc()
 		return nil
 	}
 	repositoryList := &RepositoryList{}
@@ -103,8 +154,8 @@ func (s *Lister) getRepositories() *RepositoryList {
 	return repositoryList
 }
 
-func (s *Lister) getRepoInfo(repository string) (*Repository, error) {
-	distRepo, err := getTagList(repository, s.TokenProvider)
+func (s *Registry) getRepoInfo(repository string) (*Repository, error) {
+	distRepo, err := getTagList(s.Host, repository, s.TokenProvider)
 	if err != nil {
 		return nil, err
 	}
@@ -115,12 +166,12 @@ func (s *Lister) getRepoInfo(repository string) (*Repository, error) {
 	return taggedRepository, nil
 }
 
-func (s *Lister) getTaggedRepository(repository *DistributionRepository) (*Repository, error) {
+func (s *Registry) getTaggedRepository(repository *DistributionRepository) (*Repository, error) {
 	repo := &Repository{
 		Name: repository.Name,
 	}
 	for index := range repository.Tags {
-		manifest, err := getRepositoryManifest(repository.Name, repository.Tags[index], s.TokenProvider)
+		manifest, err := getRepositoryManifest(s.Host, repository.Name, repository.Tags[index], s.TokenProvider)
 		if err != nil {
 			log.Printf("Unable to get manifest for tag: %s", err.Error())
 			repo.Tags = append(repo.Tags, Tag{
@@ -139,8 +190,8 @@ func (s *Lister) getTaggedRepository(repository *DistributionRepository) (*Repos
 	return repo, nil
 }
 
-func (s *Lister) getPublicRepositories() ([]string, error) {
-	catalog, err := getCatalog(s.TokenProvider)
+func (s *Registry) getPublicRepositories() ([]string, error) {
+	catalog, err := getCatalog(s.Host, s.TokenProvider)
 	if err != nil {
 		return nil, err
 	}
@@ -66,8 +66,8 @@ func doRequestWithBody(method, url string, tokenProvider TokenProvider, reposito
 	return resp, listBody, nil
 }
 
-func getTagList(repository string, tokenProvider TokenProvider) (*DistributionRepository, error) {
-	_, body, err := doRequestWithBody(http.MethodGet, fmt.Sprintf("%s/v2/%s/tags/list", *RegistryHost, repository), tokenProvider, repository)
+func getTagList(host string, repository string, tokenProvider TokenProvider) (*DistributionRepository, error) {
+	_, body, err := doRequestWithBody(http.MethodGet, fmt.Sprintf("%s/v2/%s/tags/list", host, repository), tokenProvider, repository)
 	if err != nil {
 		return nil, err
 	}
@@ -80,8 +80,8 @@ func getTagList(repository string, tokenProvider TokenProvider) (*DistributionRe
 	return repo, nil
 }
 
-func getCatalog(tokenProvider TokenProvider) (*Catalog, error) {
-	_, body, err := doRequestWithBody(http.MethodGet, fmt.Sprintf("%s/v2/_catalog", *RegistryHost), tokenProvider)
+func getCatalog(host string, tokenProvider TokenProvider) (*Catalog, error) {
+	_, body, err := doRequestWithBody(http.MethodGet, fmt.Sprintf("%s/v2/_catalog", host), tokenProvider)
 	if err != nil {
 		return nil, err
 	}
@@ -93,8 +93,8 @@ func getCatalog(tokenProvider TokenProvider) (*Catalog, error) {
 	return catalog, nil
 }
 
-func getRepositoryManifest(name, tag string, tokenProvider TokenProvider) (*Manifest, error) {
-	resp, body, err := doRequestWithBody(http.MethodGet, fmt.Sprintf("%s/v2/%s/manifests/%s", *RegistryHost, name, tag), tokenProvider, name)
+func getRepositoryManifest(host, name, tag string, tokenProvider TokenProvider) (*Manifest, error) {
+	resp, body, err := doRequestWithBody(http.MethodGet, fmt.Sprintf("%s/v2/%s/manifests/%s", host, name, tag), tokenProvider, name)
 	if err != nil {
 		return nil, err
 	}
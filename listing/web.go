@@ -68,9 +68,9 @@ func (s *Lister) Index(writer http.ResponseWriter, req *http.Request) {
 
 func (s *Lister) ListingIndex(writer http.ResponseWriter, req *http.Request) {
 	err := s.templates.ExecuteTemplate(writer, "listingIndex.gohtml", ListingIndex{
-		Title:        s.getHostname(req),
-		Repositories: s.repositories,
-		LastPolled:   s.lastPoll,
+		Title:      s.getHostname(req),
+		Registries: s.Registries,
+		LastPolled: s.Registries[0].LastPolled,
 	})
 	if err != nil {
 		log.Printf("Unable to output template: %s", err)
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	Enabled = flag.Bool("metrics", false, "Expose prometheus metrics at /metrics, which is unauthenticated")
+)
+
+var (
+	// AuthRequests counts token requests by outcome: authenticated, anonymous, denied or error
+	AuthRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "registryauth_auth_requests_total",
+		Help: "Token requests by outcome",
+	}, []string{"outcome"})
+	// ApprovedActions counts the actions approved in issued tokens
+	ApprovedActions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "registryauth_approved_actions_total",
+		Help: "Actions approved in issued tokens",
+	}, []string{"action"})
+	BcryptDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "registryauth_bcrypt_duration_seconds",
+		Help:    "Time taken to check bcrypt hashes",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 10),
+	})
+	SigningDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "registryauth_signing_duration_seconds",
+		Help:    "Time taken to sign tokens",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 10),
+	})
+	ListingRefreshDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "registryauth_listing_refresh_duration_seconds",
+		Help:    "Time taken to refresh the repository listing",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"registry"})
+	ListingRefreshFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "registryauth_listing_refresh_failures_total",
+		Help: "Failed refreshes of the repository listing",
+	}, []string{"registry"})
+	CertificateExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "registryauth_certificate_expiry_timestamp_seconds",
+		Help: "Unix time that the token signing certificate expires",
+	}, []string{"service"})
+)
+
+// Handler serves the metrics in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveSince records the time since start in the histogram
+func ObserveSince(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}